@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCancelledByAdmin is the cause of requests cancelled through /admin/requests
+var errCancelledByAdmin = errors.New("cancelled by an administrator")
+
+// inflightSet tracks the /get and /test requests being served
+type inflightSet struct {
+	mu       sync.Mutex
+	requests map[string]*inflightRequest // by request ID
+}
+
+// inflightRequest is one request being served, with the upstream calls it made
+type inflightRequest struct {
+	id      string
+	route   string
+	userID  string
+	started time.Time
+	cancel  context.CancelCauseFunc
+
+	mu   sync.Mutex
+	jobs []*inflightJob
+}
+
+// inflightJob is one upstream call of a request, retries included
+type inflightJob struct {
+	req      *inflightRequest
+	action   string
+	host     string
+	started  time.Time
+	attempt  int
+	finished time.Time
+	err      string
+}
+
+type inflightKey struct{}
+
+func newInflightSet() *inflightSet {
+	return &inflightSet{requests: make(map[string]*inflightRequest)}
+}
+
+// add registers req, renaming it when a caller reused a request ID
+func (s *inflightSet) add(req *inflightRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.requests[req.id] != nil {
+		var b [4]byte
+		rand.Read(b[:])
+		req.id += "-" + hex.EncodeToString(b[:])
+	}
+	s.requests[req.id] = req
+}
+
+func (s *inflightSet) remove(req *inflightRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requests[req.id] == req {
+		delete(s.requests, req.id)
+	}
+}
+
+func (s *inflightSet) get(id string) *inflightRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[id]
+}
+
+// list returns every tracked request, oldest first
+func (s *inflightSet) list() []*inflightRequest {
+	s.mu.Lock()
+	out := make([]*inflightRequest, 0, len(s.requests))
+	for _, req := range s.requests {
+		out = append(out, req)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].started.Before(out[j].started) })
+	return out
+}
+
+// inflightFrom returns the tracked request ctx belongs to. Coalesced
+// fetches keep the values of the request that started them.
+func inflightFrom(ctx context.Context) *inflightRequest {
+	req, _ := ctx.Value(inflightKey{}).(*inflightRequest)
+	return req
+}
+
+// startJob records an upstream call. A nil request records nothing.
+func (r *inflightRequest) startJob(action, host string) *inflightJob {
+	if r == nil {
+		return nil
+	}
+	job := &inflightJob{req: r, action: action, host: host, started: time.Now()}
+	r.mu.Lock()
+	r.jobs = append(r.jobs, job)
+	r.mu.Unlock()
+	return job
+}
+
+// setAttempt records which attempt of the job is running
+func (j *inflightJob) setAttempt(attempt int) {
+	if j == nil {
+		return
+	}
+	j.req.mu.Lock()
+	defer j.req.mu.Unlock()
+	j.attempt = attempt
+}
+
+func (j *inflightJob) finish(err error) {
+	if j == nil {
+		return
+	}
+	j.req.mu.Lock()
+	defer j.req.mu.Unlock()
+	j.finished = time.Now()
+	if err != nil {
+		j.err = err.Error()
+	}
+}
+
+// InflightJobStatus is one upstream call as /admin/requests shows it
+type InflightJobStatus struct {
+	Action    string  `json:"action"`
+	Host      string  `json:"host"`
+	State     string  `json:"state"` // running, done or failed
+	Attempt   int     `json:"attempt"`
+	ElapsedMs float64 `json:"elapsedMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// InflightStatus is one request as /admin/requests shows it
+type InflightStatus struct {
+	ID        string              `json:"id"`
+	Route     string              `json:"route"`
+	UserID    string              `json:"userId,omitempty"`
+	StartedAt int64               `json:"startedAt"`
+	ElapsedMs float64             `json:"elapsedMs"`
+	Jobs      []InflightJobStatus `json:"jobs"`
+}
+
+func (r *inflightRequest) status(now time.Time) InflightStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := InflightStatus{
+		ID:        r.id,
+		Route:     r.route,
+		UserID:    r.userID,
+		StartedAt: r.started.UnixMilli(),
+		ElapsedMs: ms(now.Sub(r.started)),
+		Jobs:      make([]InflightJobStatus, 0, len(r.jobs)),
+	}
+	for _, j := range r.jobs {
+		job := InflightJobStatus{Action: j.action, Host: j.host, State: "running", Attempt: j.attempt, Error: j.err}
+		end := now
+		if !j.finished.IsZero() {
+			end = j.finished
+			job.State = "done"
+			if j.err != "" {
+				job.State = "failed"
+			}
+		}
+		job.ElapsedMs = ms(end.Sub(j.started))
+		out.Jobs = append(out.Jobs, job)
+	}
+	return out
+}
+
+// trackInflight lists the request on /admin/requests while it runs and
+// lets an administrator cancel it
+func (s *Server) trackInflight(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+
+		req := &inflightRequest{id: requestIDFrom(ctx), route: route, started: time.Now(), cancel: cancel}
+		if user, ok := userFromContext(ctx); ok {
+			req.userID = user.ID
+		}
+		s.inflight.add(req)
+		defer s.inflight.remove(req)
+
+		next(w, r.WithContext(context.WithValue(ctx, inflightKey{}, req)))
+	}
+}
+
+// cancelledByAdmin reports whether ctx was cancelled through /admin/requests
+func cancelledByAdmin(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errCancelledByAdmin)
+}
+
+// writeCancelled answers a request an administrator cancelled
+func (s *Server) writeCancelled(w http.ResponseWriter) {
+	s.writeJSON(w, http.StatusServiceUnavailable, ProxyResponse{
+		Success: false,
+		Code:    "REQUEST_CANCELLED",
+		Message: "Request " + errCancelledByAdmin.Error(),
+		Data:    nil,
+	})
+}
+
+// hostStatsSet keeps attempt outcomes and latency per provider host
+type hostStatsSet struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+type hostStats struct {
+	attempts      int64
+	failures      int64
+	latency       time.Duration // sum over attempts, for the average
+	lastLatency   time.Duration
+	lastError     string
+	lastErrorAt   time.Time
+	lastSuccessAt time.Time
+	lastSeen      time.Time
+}
+
+func newHostStatsSet() *hostStatsSet {
+	return &hostStatsSet{hosts: make(map[string]*hostStats)}
+}
+
+// record counts one upstream attempt. Ignored outcomes, such as a client
+// going away, say nothing about the host and are skipped.
+func (h *hostStatsSet) record(host string, outcome breakerOutcome, latency time.Duration, err error) {
+	if outcome == outcomeIgnored {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.hosts[host]
+	if !ok {
+		h.prune()
+		st = &hostStats{}
+		h.hosts[host] = st
+	}
+	now := time.Now()
+	st.attempts++
+	st.latency += latency
+	st.lastLatency = latency
+	st.lastSeen = now
+	if err != nil {
+		st.failures++
+		st.lastError = err.Error()
+		st.lastErrorAt = now
+	} else {
+		st.lastSuccessAt = now
+	}
+}
+
+// prune makes room once many hosts are tracked: hosts idle for an hour go
+// first, then the least recently used one. Callers must hold h.mu.
+func (h *hostStatsSet) prune() {
+	if len(h.hosts) < maxTrackedHosts {
+		return
+	}
+	var oldest string
+	for host, st := range h.hosts {
+		if time.Since(st.lastSeen) > time.Hour {
+			delete(h.hosts, host)
+		} else if oldest == "" || st.lastSeen.Before(h.hosts[oldest].lastSeen) {
+			oldest = host
+		}
+	}
+	if len(h.hosts) >= maxTrackedHosts {
+		delete(h.hosts, oldest)
+	}
+}
+
+// UpstreamStatus is one provider host as /admin/upstreams shows it
+type UpstreamStatus struct {
+	Host          string  `json:"host"`
+	Attempts      int64   `json:"attempts"`
+	Failures      int64   `json:"failures"`
+	SuccessRate   float64 `json:"successRate"`
+	AvgLatencyMs  float64 `json:"avgLatencyMs"`
+	LastLatencyMs float64 `json:"lastLatencyMs"`
+	LastSuccessAt int64   `json:"lastSuccessAt,omitempty"`
+	LastError     string  `json:"lastError,omitempty"`
+	LastErrorAt   int64   `json:"lastErrorAt,omitempty"`
+	Breaker       string  `json:"breaker"`
+	RetryIn       int64   `json:"breakerRetryInMs,omitempty"`
+}
+
+// upstreamStatuses joins host statistics with breaker states, sorted by host
+func (s *Server) upstreamStatuses() []UpstreamStatus {
+	byHost := make(map[string]*UpstreamStatus)
+
+	s.hostStats.mu.Lock()
+	for host, st := range s.hostStats.hosts {
+		status := &UpstreamStatus{
+			Host:          host,
+			Attempts:      st.attempts,
+			Failures:      st.failures,
+			SuccessRate:   float64(st.attempts-st.failures) / float64(st.attempts),
+			AvgLatencyMs:  ms(st.latency / time.Duration(st.attempts)),
+			LastLatencyMs: ms(st.lastLatency),
+			LastError:     st.lastError,
+			Breaker:       breakerClosed.String(),
+		}
+		if !st.lastSuccessAt.IsZero() {
+			status.LastSuccessAt = st.lastSuccessAt.UnixMilli()
+		}
+		if !st.lastErrorAt.IsZero() {
+			status.LastErrorAt = st.lastErrorAt.UnixMilli()
+		}
+		byHost[host] = status
+	}
+	s.hostStats.mu.Unlock()
+
+	// Breakers can outlive pruned statistics; list them anyway
+	for _, b := range s.breakers.statuses() {
+		status, ok := byHost[b.Host]
+		if !ok {
+			status = &UpstreamStatus{Host: b.Host, LastError: b.LastError}
+			byHost[b.Host] = status
+		}
+		status.Breaker = b.State
+		status.RetryIn = b.RetryIn
+	}
+
+	out := make([]UpstreamStatus, 0, len(byHost))
+	for _, status := range byHost {
+		out = append(out, *status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// writeMethodNotAllowed answers a method the route does not support
+func (s *Server) writeMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	s.writeJSON(w, http.StatusMethodNotAllowed, ProxyResponse{
+		Success: false,
+		Code:    "METHOD_NOT_ALLOWED",
+		Message: "Method not allowed",
+		Data:    nil,
+	})
+}
+
+// handleInflight lists the /get and /test requests being served
+func (s *Server) handleInflight(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeMethodNotAllowed(w, "GET")
+		return
+	}
+
+	now := time.Now()
+	requests := s.inflight.list()
+	out := make([]InflightStatus, 0, len(requests))
+	for _, req := range requests {
+		out = append(out, req.status(now))
+	}
+	s.writeJSON(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    map[string]any{"requests": out},
+	})
+}
+
+// handleCancelRequest cancels a stuck request by its X-Request-ID. The
+// client gets 503 with "code": "REQUEST_CANCELLED".
+func (s *Server) handleCancelRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		s.writeMethodNotAllowed(w, "DELETE")
+		return
+	}
+
+	req := s.inflight.get(r.PathValue("id"))
+	if req == nil {
+		s.writeJSON(w, http.StatusNotFound, ProxyResponse{
+			Success: false,
+			Code:    "NOT_FOUND",
+			Message: "No such request in flight",
+			Data:    nil,
+		})
+		return
+	}
+	req.cancel(errCancelledByAdmin)
+	logFor(r.Context()).Warn("Request cancelled by administrator", "cancelled_request_id", req.id, "route", req.route)
+	s.writeJSON(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Message: "Request cancelled",
+		Data:    req.status(time.Now()),
+	})
+}
+
+// handleUpstreams reports per provider host statistics and breaker states
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeMethodNotAllowed(w, "GET")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    map[string]any{"upstreams": s.upstreamStatuses()},
+	})
+}
+
+// handleCache lists cached catalogs on GET and purges them on DELETE:
+// one entry with ?key=, every account of a provider with ?host=, or
+// everything without either
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		entries := []CacheEntryStatus{}
+		if s.cache != nil {
+			entries = s.cache.statuses(time.Now())
+		}
+		s.writeJSON(w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Data:    map[string]any{"enabled": s.cache != nil, "entries": entries},
+		})
+
+	case http.MethodDelete:
+		key, host := r.URL.Query().Get("key"), strings.ToLower(r.URL.Query().Get("host"))
+		purged := 0
+		if s.cache != nil {
+			purged = s.cache.purge(func(k string) bool {
+				switch {
+				case key != "":
+					return k == key
+				case host != "":
+					base, _, _ := strings.Cut(k, "|")
+					return providerHost(base) == host
+				default:
+					return true
+				}
+			})
+		}
+		logFor(r.Context()).Info("Cache purged", "entries", purged, "key", key, "host", host)
+		s.writeJSON(w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Message: "Cache purged",
+			Data:    map[string]any{"purged": purged},
+		})
+
+	default:
+		s.writeMethodNotAllowed(w, "GET, DELETE")
+	}
+}
+
+// handlePprof serves net/http/pprof when admin.pprof is on
+func (s *Server) handlePprof(w http.ResponseWriter, r *http.Request) {
+	if !s.current().config.Pprof {
+		http.NotFound(w, r)
+		return
+	}
+
+	// pprof.Index finds named profiles under /debug/pprof/
+	http.StripPrefix("/admin", http.HandlerFunc(servePprof)).ServeHTTP(w, r)
+}
+
+func servePprof(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
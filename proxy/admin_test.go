@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminClosedWithoutAuth(t *testing.T) {
+	s := newTestServer(t, nil)
+	s.cache.store("provider.example|alice", "fp", &NormalizedData{}, map[string]time.Time{"live_streams": time.Now()})
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		w := serve(s, httptest.NewRequest(method, "/admin/cache", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s /admin/cache without auth = %d, want 404", method, w.Code)
+		}
+	}
+	if s.cache.len() != 1 {
+		t.Error("cache was purged through the unauthenticated admin API")
+	}
+}
+
+func TestAdminRequiresAdminRole(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.Auth.Secret = "sek"
+		c.Auth.AdminUsers = []string{"12"}
+	})
+	exp := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"session token", signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": "1", "exp": exp}), http.StatusForbidden},
+		{"admin user session token", signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 12, "email": "ops@example.com", "exp": exp}), http.StatusOK},
+		{"user role", signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": "1", "role": "user", "exp": exp}), http.StatusForbidden},
+		{"admin role", signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": "1", "role": "admin", "exp": exp}), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/cache", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if w := serve(s, r); w.Code != tt.want {
+				t.Errorf("GET /admin/cache = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminCancelsRequest(t *testing.T) {
+	p, allow := newPanel(t)
+	entered, release := p.hold("get_live_streams")
+	defer release()
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.Auth.Secret = "sek"
+		c.Auth.AdminUsers = []string{"1"}
+	})
+	exp := time.Now().Add(time.Hour).Unix()
+	userToken := signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 7, "exp": exp})
+	adminToken := signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 1, "exp": exp})
+
+	stuck := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		r := catalogRequest(p.URL, "")
+		r.Header.Set("Authorization", "Bearer "+userToken)
+		r.Header.Set("X-Request-ID", "stuck-1")
+		stuck <- serve(s, r)
+	}()
+	<-entered
+
+	admin := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, r)
+	}
+	if w := admin(http.MethodGet, "/admin/requests", adminToken); !strings.Contains(w.Body.String(), `"stuck-1"`) {
+		t.Fatalf("/admin/requests does not list the stuck request: %s", w.Body)
+	}
+	if w := admin(http.MethodDelete, "/admin/requests/stuck-1", userToken); w.Code != http.StatusForbidden {
+		t.Errorf("cancel by a regular user = %d, want 403", w.Code)
+	}
+	if w := admin(http.MethodDelete, "/admin/requests/unknown", adminToken); w.Code != http.StatusNotFound {
+		t.Errorf("cancel of an unknown request = %d, want 404", w.Code)
+	}
+
+	w := admin(http.MethodDelete, "/admin/requests/stuck-1", adminToken)
+	var resp struct {
+		Success bool           `json:"success"`
+		Message string         `json:"message"`
+		Data    InflightStatus `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || !resp.Success || resp.Message != "Request cancelled" || resp.Data.ID != "stuck-1" || resp.Data.UserID != "7" {
+		t.Errorf("cancel = %d %s", w.Code, w.Body)
+	}
+
+	select {
+	case got := <-stuck:
+		if got.Code != http.StatusServiceUnavailable || !strings.Contains(got.Body.String(), `"REQUEST_CANCELLED"`) {
+			t.Errorf("cancelled client got %d: %s", got.Code, got.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled request never answered")
+	}
+	if s.inflight.get("stuck-1") != nil {
+		t.Error("the cancelled request is still tracked")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusClientClosedRequest is logged for requests whose client left while
+// they were queued, as nginx does
+const statusClientClosedRequest = 499
+
+var (
+	errQueueFull    = errors.New("wait queue is full")
+	errQueueTimeout = errors.New("waited too long for a slot")
+)
+
+// PoolConfig is one route class's share of server.max_concurrent
+type PoolConfig struct {
+	Size     int // concurrent requests of the class
+	Reserved int // slots only this class may use, kept free of the others
+	Priority int // when slots free up, waiters of higher classes go first
+}
+
+// admission bounds concurrent /get and /test requests. Each route has its
+// own pool within the shared capacity; when a pool cannot take a request,
+// callers wait in FIFO order instead of being turned away at once.
+type admission struct {
+	mu       sync.Mutex
+	capacity int
+	inUse    int
+	pools    map[string]*admissionPool
+	order    []*admissionPool // by priority, highest first
+}
+
+type admissionPool struct {
+	name    string
+	config  PoolConfig
+	inUse   int
+	queue   *list.List    // of chan struct{}, closed when handed a slot
+	avgHold time.Duration // moving average of how long a slot is held, for estimates
+}
+
+// queueTicket describes a caller's wait, for the response headers
+type queueTicket struct {
+	queued   bool
+	position int           // place in line at arrival, 1 is next; not updated while waiting
+	estimate time.Duration // expected wait at arrival
+	waited   time.Duration
+}
+
+func newAdmission(capacity int, pools map[string]*PoolConfig) *admission {
+	a := &admission{capacity: capacity, pools: make(map[string]*admissionPool)}
+	for name := range pools {
+		a.pools[name] = &admissionPool{name: name, queue: list.New()}
+	}
+	a.setPools(pools)
+	return a
+}
+
+// setPools applies new pool settings on reload and admits whoever they let in
+func (a *admission) setPools(pools map[string]*PoolConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.order = a.order[:0]
+	for name, p := range a.pools {
+		if config, ok := pools[name]; ok {
+			p.config = *config
+		}
+		a.order = append(a.order, p)
+	}
+	sort.Slice(a.order, func(i, j int) bool {
+		if a.order[i].config.Priority != a.order[j].config.Priority {
+			return a.order[i].config.Priority > a.order[j].config.Priority
+		}
+		return a.order[i].name < a.order[j].name
+	})
+	a.dispatch()
+}
+
+// acquire takes a slot of pool, waiting behind earlier callers while its
+// queue is shorter than maxQueue, for at most maxWait. It gives up as soon
+// as ctx is done. The returned func gives the slot back.
+func (a *admission) acquire(ctx context.Context, pool string, maxQueue int, maxWait time.Duration) (func(), queueTicket, error) {
+	a.mu.Lock()
+	p := a.pools[pool]
+	if p.queue.Len() == 0 && a.canTake(p) {
+		a.take(p)
+		a.mu.Unlock()
+		return a.holder(p, time.Now()), queueTicket{}, nil
+	}
+
+	ticket := queueTicket{position: p.queue.Len() + 1}
+	ticket.estimate = p.avgHold * time.Duration(ticket.position) / time.Duration(p.config.Size)
+	if ticket.position > maxQueue || maxWait <= 0 {
+		a.mu.Unlock()
+		return nil, ticket, errQueueFull
+	}
+	ready := make(chan struct{})
+	el := p.queue.PushBack(ready)
+	ticket.queued = true
+	a.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+		ticket.waited = time.Since(start)
+		return a.holder(p, time.Now()), ticket, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	select {
+	case <-ready:
+		// Handed a slot just as we gave up; pass it on
+		a.release(p)
+	default:
+		p.queue.Remove(el)
+	}
+	ticket.waited = time.Since(start)
+	return nil, ticket, err
+}
+
+// canTake reports whether p may start another request: it is under its own
+// size, and a slot is free beyond what other pools keep reserved.
+// Callers must hold a.mu.
+func (a *admission) canTake(p *admissionPool) bool {
+	if p.inUse >= p.config.Size {
+		return false
+	}
+	heldBack := 0
+	for _, other := range a.order {
+		if other != p {
+			heldBack += max(0, other.config.Reserved-other.inUse)
+		}
+	}
+	return a.capacity-a.inUse > heldBack
+}
+
+// take and release count a slot of p. Callers must hold a.mu.
+func (a *admission) take(p *admissionPool) {
+	p.inUse++
+	a.inUse++
+}
+
+func (a *admission) release(p *admissionPool) {
+	p.inUse--
+	a.inUse--
+	a.dispatch()
+}
+
+// dispatch hands free slots to waiters, highest priority pool first.
+// Callers must hold a.mu.
+func (a *admission) dispatch() {
+	for _, p := range a.order {
+		for p.queue.Len() > 0 && a.canTake(p) {
+			a.take(p)
+			close(p.queue.Remove(p.queue.Front()).(chan struct{}))
+		}
+	}
+}
+
+// holder returns the release func of a slot of p taken at start
+func (a *admission) holder(p *admissionPool, start time.Time) func() {
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		hold := time.Since(start)
+		if p.avgHold == 0 {
+			p.avgHold = hold
+		} else {
+			p.avgHold += (hold - p.avgHold) / 8
+		}
+		a.release(p)
+	}
+}
+
+// stats returns the slots in use, the capacity and the queue length
+func (a *admission) stats() (inUse, capacity, queued int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, p := range a.order {
+		queued += p.queue.Len()
+	}
+	return a.inUse, a.capacity, queued
+}
+
+// PoolStatus is the state of one pool for /ready and /metrics
+type PoolStatus struct {
+	InUse    int `json:"inUse"`
+	Size     int `json:"size"`
+	Reserved int `json:"reserved"`
+	Priority int `json:"priority"`
+	Queued   int `json:"queued"`
+}
+
+func (a *admission) poolStats() map[string]PoolStatus {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out := make(map[string]PoolStatus, len(a.pools))
+	for name, p := range a.pools {
+		out[name] = PoolStatus{InUse: p.inUse, Size: p.config.Size, Reserved: p.config.Reserved, Priority: p.config.Priority, Queued: p.queue.Len()}
+	}
+	return out
+}
+
+// admit takes a concurrency slot of pool for r, queueing as
+// server.queue_size and server.queue_max_wait allow, and turns requests away
+// once a drain has started. When it fails the response has been written.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, pool string) (func(), bool) {
+	if s.draining.Load() {
+		// Requests already admitted finish; new ones go to another instance
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Retry-After", "1")
+		s.writeJSON(w, http.StatusServiceUnavailable, ProxyResponse{
+			Success: false,
+			Code:    "SHUTTING_DOWN",
+			Message: "Server is shutting down, please retry",
+			Data:    nil,
+		})
+		return nil, false
+	}
+
+	config := s.current().config
+	release, ticket, err := s.admission.acquire(r.Context(), pool, config.QueueSize, config.QueueMaxWait)
+	// The position is where the request joined the line: the headers go
+	// out with the response, after the wait
+	if ticket.queued {
+		w.Header().Set("X-Queue-Position", strconv.Itoa(ticket.position))
+		// No estimate until a slot has been released once
+		if ticket.estimate > 0 {
+			w.Header().Set("X-Queue-Estimated-Wait", strconv.FormatFloat(ticket.estimate.Seconds(), 'f', 1, 64))
+		}
+		s.metrics.queueWait.observe(ticket.waited.Seconds())
+	}
+	if err == nil {
+		return release, true
+	}
+
+	switch {
+	case errors.Is(err, errQueueFull):
+		s.metrics.queueRejected.inc("full")
+	case errors.Is(err, errQueueTimeout):
+		s.metrics.queueRejected.inc("timeout")
+	default:
+		// The client went away; nobody reads the answer
+		s.metrics.queueRejected.inc("client_gone")
+		logFor(r.Context()).Debug("Client left the wait queue", "position", ticket.position, "waited_ms", ms(ticket.waited))
+		w.WriteHeader(statusClientClosedRequest)
+		return nil, false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(ticket.estimate.Seconds())))))
+	s.writeJSON(w, http.StatusTooManyRequests, ProxyResponse{
+		Success: false,
+		Code:    "SERVER_BUSY",
+		Message: "Server too busy, please try again later",
+		Data:    nil,
+	})
+	return nil, false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Requests are read and validated before they wait for a slot, so bad ones
+// are answered at once and never hold a queue position
+func TestInvalidRequestsSkipTheQueue(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.MaxConcurrent = 1
+		c.Pools = map[string]*PoolConfig{"/get": {Size: 1}, "/test": {Size: 1}}
+		c.QueueMaxWait = time.Minute
+	})
+	release, _, err := s.admission.acquire(context.Background(), "/get", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	for _, path := range []string{"/get", "/test"} {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"base_url":`))
+			r.Header.Set("Content-Type", "application/json")
+			done <- serve(s, r)
+		}()
+		select {
+		case w := <-done:
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("malformed POST %s = %d, want 400", path, w.Code)
+			}
+			if w.Header().Get("X-Queue-Position") != "" {
+				t.Errorf("malformed POST %s was queued", path)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("malformed POST %s waited for a slot", path)
+		}
+	}
+	if _, _, queued := s.admission.stats(); queued != 0 {
+		t.Errorf("%d requests left queued", queued)
+	}
+}
+
+// A playlist lookup costs a query against the API, so it happens only once
+// the request holds a slot
+func TestPlaylistLookupWaitsForAdmission(t *testing.T) {
+	p, allow := newPanel(t)
+	var lookups atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		fmt.Fprintf(w, `{"success":true,"data":{"user_id":"7","url":%q,"username":"alice","password":"secret"}}`, p.URL)
+	}))
+	t.Cleanup(api.Close)
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.Auth.Secret = "sek"
+		c.Playlists.CallbackURL = api.URL + "/playlists/{id}"
+		c.MaxConcurrent = 1
+		c.Pools = map[string]*PoolConfig{"/get": {Size: 1}, "/test": {Size: 1}}
+		c.QueueMaxWait = 50 * time.Millisecond
+	})
+	token := signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 7, "exp": time.Now().Add(time.Hour).Unix()})
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{"playlist_id":"6f1c2a9e-0b7d-4c3e-9a51-2d8f4e6b7c10"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, r)
+	}
+
+	release, _, err := s.admission.acquire(context.Background(), "/test", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := request(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("playlist request while saturated = %d, want 429", w.Code)
+	}
+	if n := lookups.Load(); n != 0 {
+		t.Errorf("%d playlist lookups made without a slot", n)
+	}
+
+	release()
+	if w := request(); w.Code != http.StatusOK {
+		t.Errorf("playlist request = %d: %s", w.Code, w.Body)
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Errorf("%d playlist lookups, want 1", n)
+	}
+}
+
+// waitQueued blocks until n requests wait for a slot
+func waitQueued(t *testing.T, a *admission, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, _, queued := a.stats(); queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d requests never queued", n)
+}
+
+func TestReservedSlotsStayFree(t *testing.T) {
+	a := newAdmission(3, map[string]*PoolConfig{
+		"/get":  {Size: 3},
+		"/test": {Size: 3, Reserved: 1},
+	})
+	for i := range 2 {
+		if _, _, err := a.acquire(context.Background(), "/get", 0, 0); err != nil {
+			t.Fatalf("/get %d: %v", i, err)
+		}
+	}
+	if _, _, err := a.acquire(context.Background(), "/get", 0, 0); !errors.Is(err, errQueueFull) {
+		t.Errorf("/get into the reserved slot = %v, want %v", err, errQueueFull)
+	}
+	release, _, err := a.acquire(context.Background(), "/test", 0, 0)
+	if err != nil {
+		t.Fatalf("/test with /get saturated: %v", err)
+	}
+
+	// Once /test holds its reserve the reserve no longer blocks anyone
+	release()
+	if _, _, err := a.acquire(context.Background(), "/test", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, _, _ := a.stats(); inUse != 3 {
+		t.Errorf("%d slots in use, want 3", inUse)
+	}
+}
+
+func TestPriorityPoolServedFirst(t *testing.T) {
+	a := newAdmission(1, map[string]*PoolConfig{
+		"/get":  {Size: 1},
+		"/test": {Size: 1, Priority: 10},
+	})
+	release, _, err := a.acquire(context.Background(), "/get", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan string, 2)
+	wait := func(pool string) {
+		done, _, err := a.acquire(context.Background(), pool, 10, time.Minute)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		served <- pool
+		done()
+	}
+	go wait("/get")
+	waitQueued(t, a, 1)
+	go wait("/test")
+	waitQueued(t, a, 2)
+
+	release()
+	if first, second := <-served, <-served; first != "/test" || second != "/get" {
+		t.Errorf("served %s then %s, want the higher priority /test first", first, second)
+	}
+}
+
+func TestQueueHeaders(t *testing.T) {
+	p, allow := newPanel(t)
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.MaxConcurrent = 1
+		c.Pools = map[string]*PoolConfig{"/get": {Size: 1}, "/test": {Size: 1}}
+		c.QueueMaxWait = time.Minute
+	})
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{"base_url":"`+p.URL+`","username":"alice","password":"secret"}`))
+		return serve(s, r)
+	}
+
+	// A slot held for a while gives the pool a hold time to estimate from
+	release, _, err := s.admission.acquire(context.Background(), "/test", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	release()
+
+	if w := request(); w.Header().Get("X-Queue-Position") != "" {
+		t.Errorf("request admitted at once carries X-Queue-Position %q", w.Header().Get("X-Queue-Position"))
+	}
+
+	release, _, err = s.admission.acquire(context.Background(), "/test", 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses := make([]chan *httptest.ResponseRecorder, 2)
+	for i := range responses {
+		responses[i] = make(chan *httptest.ResponseRecorder, 1)
+		go func() { responses[i] <- request() }()
+		waitQueued(t, s.admission, i+1)
+	}
+	release()
+
+	for i, ch := range responses {
+		w := <-ch
+		if w.Code != http.StatusOK {
+			t.Errorf("queued request %d = %d: %s", i+1, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Queue-Position"); got != fmt.Sprint(i+1) {
+			t.Errorf("queued request %d has X-Queue-Position %q, want its place on arrival", i+1, got)
+		}
+		if w.Header().Get("X-Queue-Estimated-Wait") == "" {
+			t.Errorf("queued request %d has no X-Queue-Estimated-Wait", i+1)
+		}
+	}
+}
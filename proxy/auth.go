@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AuthConfig enables JWT authentication of the proxy routes. Tokens are the
+// HS256 JWTs issued by the API; with neither Secret nor JWKSFile set the
+// proxy stays open.
+type AuthConfig struct {
+	Secret     string        // shared HS256 secret (the API's JWT_SECRET)
+	JWKSFile   string        // JWKS of "oct" keys, selected by the token's kid
+	Roles      []string      // must stay empty: the API's tokens carry no role, see validate
+	AdminRoles []string      // roles allowed on /admin
+	AdminUsers []string      // user ids allowed on /admin whatever their role
+	Leeway     time.Duration // clock skew tolerated on exp and nbf
+	Issuer     string        // required iss claim; empty skips the check
+	Audience   string        // required aud entry; empty skips the check
+}
+
+func (c AuthConfig) enabled() bool {
+	return c.Secret != "" || c.JWKSFile != ""
+}
+
+// isAdmin says whether user may use /admin: its id is in AdminUsers or its
+// role in AdminRoles. With both empty any authenticated caller may.
+func (c AuthConfig) isAdmin(user authUser) bool {
+	if len(c.AdminRoles) == 0 && len(c.AdminUsers) == 0 {
+		return true
+	}
+	return slices.Contains(c.AdminUsers, user.ID) || (user.Role != "" && slices.Contains(c.AdminRoles, user.Role))
+}
+
+// Roles the API assigns to users
+var knownRoles = []string{"user", "reseller", "admin"}
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// authUser is the authenticated caller, attached to the request context
+type authUser struct {
+	ID    string
+	Email string
+	Role  string // empty when the token carries no role claim
+	Token string // raw bearer token, forwarded to the API's playlist callback
+}
+
+type authUserKey struct{}
+
+// userFromContext returns the caller authenticated by requireAuth, if any
+func userFromContext(ctx context.Context) (authUser, bool) {
+	user, ok := ctx.Value(authUserKey{}).(authUser)
+	return user, ok
+}
+
+// jwtClaims are the claims the proxy reads. The API signs {userId, email}
+// plus exp; sub, role, iss and aud are honoured when present.
+type jwtClaims struct {
+	UserID    flexString    `json:"userId"`
+	Subject   flexString    `json:"sub"`
+	Email     string        `json:"email"`
+	Role      string        `json:"role"`
+	Type      string        `json:"type"` // "profile" for profile selection tokens
+	ExpiresAt *int64        `json:"exp"`
+	NotBefore *int64        `json:"nbf"`
+	Issuer    string        `json:"iss"`
+	Audience  audienceClaim `json:"aud"`
+}
+
+// audienceClaim is aud, which RFC 7519 allows as a string or an array
+type audienceClaim []string
+
+func (a *audienceClaim) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audienceClaim{one}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+// jwtVerifier checks HS256 signatures and standard claims
+type jwtVerifier struct {
+	secret   []byte
+	keys     map[string][]byte // JWKS keys by kid
+	leeway   time.Duration
+	issuer   string
+	audience string
+}
+
+func newJWTVerifier(config AuthConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{leeway: config.Leeway, issuer: config.Issuer, audience: config.Audience}
+	if config.Secret != "" {
+		v.secret = []byte(config.Secret)
+	}
+	if config.JWKSFile != "" {
+		keys, err := loadJWKS(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+	}
+	return v, nil
+}
+
+// loadJWKS reads symmetric ("oct") keys from a JWK set
+func loadJWKS(path string) (map[string][]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS in %s: %w", path, err)
+	}
+
+	keys := make(map[string][]byte, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kty != "oct" || (key.Alg != "" && key.Alg != "HS256") {
+			continue
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.K, "="))
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("invalid JWKS in %s: bad key %q", path, key.Kid)
+		}
+		keys[key.Kid] = secret
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("invalid JWKS in %s: no HS256 keys", path)
+	}
+	return keys, nil
+}
+
+// verify checks token's signature, expiry, not-before and, when configured,
+// issuer and audience, and returns its claims
+func (v *jwtVerifier) verify(token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return claims, errInvalidToken
+	}
+	// Only HS256; anything else, "none" included, is rejected outright
+	if header.Alg != "HS256" {
+		return claims, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if !v.signatureValid(parts[0]+"."+parts[1], signature, header.Kid) {
+		return claims, errInvalidToken
+	}
+
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return claims, errInvalidToken
+	}
+	if claims.ExpiresAt == nil {
+		return claims, errInvalidToken
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(v.leeway)) {
+		return claims, errExpiredToken
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return claims, errInvalidToken
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return claims, errInvalidToken
+	}
+	if v.audience != "" && !slices.Contains(claims.Audience, v.audience) {
+		return claims, errInvalidToken
+	}
+	return claims, nil
+}
+
+// signatureValid tries the JWKS key named by kid, or every candidate key
+// when the token has no kid
+func (v *jwtVerifier) signatureValid(signed string, signature []byte, kid string) bool {
+	var candidates [][]byte
+	if key, ok := v.keys[kid]; ok && kid != "" {
+		candidates = append(candidates, key)
+	} else if kid == "" {
+		if v.secret != nil {
+			candidates = append(candidates, v.secret)
+		}
+		for _, key := range v.keys {
+			candidates = append(candidates, key)
+		}
+	}
+
+	for _, key := range candidates {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// authenticate resolves the caller from the Authorization header
+func (s *Server) authenticate(r *http.Request, verifier *jwtVerifier) (authUser, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return authUser{}, errMissingToken
+	}
+
+	claims, err := verifier.verify(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		return authUser{}, err
+	}
+
+	// Profile selection tokens carry a userId too but are not sessions
+	if claims.Type == "profile" {
+		return authUser{}, errInvalidToken
+	}
+	id := string(claims.UserID)
+	if id == "" {
+		id = string(claims.Subject)
+	}
+	if id == "" {
+		return authUser{}, errInvalidToken
+	}
+	if claims.Role != "" && !slices.Contains(knownRoles, claims.Role) {
+		return authUser{}, errInvalidToken
+	}
+	return authUser{ID: id, Email: claims.Email, Role: claims.Role, Token: strings.TrimSpace(token)}, nil
+}
+
+// requireAuth rejects requests without a valid token and attaches the
+// caller to the request context. It is a no-op while authentication is not
+// configured.
+func (s *Server) requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(nil, "", true, next)
+}
+
+// requireAdmin is requireAuth for the /admin routes, which also check
+// auth.admin_users and auth.admin_roles. Unlike the proxy routes they fail
+// closed: without authentication configured they answer 404.
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return s.requireRole(AuthConfig.isAdmin, "The admin API requires an admin user or role", false, next)
+}
+
+// requireRole authenticates the caller and, when allowed is set, asks it
+// whether the current configuration lets the caller in. open says whether
+// the route is served to anyone while authentication is not configured.
+func (s *Server) requireRole(allowed func(AuthConfig, authUser) bool, denied string, open bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt := s.current()
+		if rt.verifier == nil {
+			if open {
+				next(w, r)
+				return
+			}
+			s.writeJSON(w, http.StatusNotFound, ProxyResponse{
+				Success: false,
+				Code:    "NOT_FOUND",
+				Message: "Not found",
+				Data:    nil,
+			})
+			return
+		}
+
+		user, err := s.authenticate(r, rt.verifier)
+		if err != nil {
+			challenge := `Bearer error="invalid_token"`
+			if errors.Is(err, errMissingToken) {
+				challenge = "Bearer"
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			s.writeJSON(w, http.StatusUnauthorized, ProxyResponse{
+				Success: false,
+				Code:    "UNAUTHORIZED",
+				Message: "Unauthorized: " + err.Error(),
+				Data:    nil,
+			})
+			return
+		}
+
+		if allowed != nil && !allowed(rt.config.Auth, user) {
+			s.writeJSON(w, http.StatusForbidden, ProxyResponse{
+				Success: false,
+				Code:    "FORBIDDEN",
+				Message: denied,
+				Data:    nil,
+			})
+			return
+		}
+
+		setLogUser(r, user.ID)
+		next(w, r.WithContext(context.WithValue(r.Context(), authUserKey{}, user)))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTVerifier(t *testing.T) {
+	const secret, opsKey = "api-secret", "operator-key"
+	jwks := filepath.Join(t.TempDir(), "jwks.json")
+	k := base64.RawURLEncoding.EncodeToString([]byte(opsKey))
+	if err := os.WriteFile(jwks, []byte(`{"keys":[{"kty":"oct","kid":"ops","alg":"HS256","k":"`+k+`"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const leeway = 30 * time.Second
+	now := time.Unix(1_700_000_000, 0)
+	v, err := newJWTVerifier(AuthConfig{Secret: secret, JWKSFile: jwks, Leeway: leeway})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped, err := newJWTVerifier(AuthConfig{Secret: secret, Leeway: leeway, Issuer: "syncstream-api", Audience: "proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	claims := func(extra map[string]any) map[string]any {
+		c := map[string]any{"userId": "42", "exp": now.Add(time.Hour).Unix()}
+		for key, value := range extra {
+			if value == nil {
+				delete(c, key)
+			} else {
+				c[key] = value
+			}
+		}
+		return c
+	}
+	sign := func(key string, header, claims map[string]any) string { return signHS256(t, key, header, claims) }
+	valid := sign(secret, hs256, claims(nil))
+
+	tests := []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		want     error
+	}{
+		{"valid", v, valid, nil},
+		{"alg none", v, strings.Join(strings.Split(sign(secret, map[string]any{"alg": "none"}, claims(nil)), ".")[:2], ".") + ".", errInvalidToken},
+		{"alg none signed", v, sign(secret, map[string]any{"alg": "none"}, claims(nil)), errInvalidToken},
+		{"alg mismatch", v, sign(secret, map[string]any{"alg": "HS512"}, claims(nil)), errInvalidToken},
+		{"alg RS256", v, sign(secret, map[string]any{"alg": "RS256"}, claims(nil)), errInvalidToken},
+		{"not a jwt", v, "abc.def", errInvalidToken},
+		{"bad signature", v, valid[:len(valid)-4] + "AAAA", errInvalidToken},
+		{"wrong key", v, sign("other-secret", hs256, claims(nil)), errInvalidToken},
+		{"tampered claims", v, strings.Split(valid, ".")[0] + "." + strings.Split(sign(secret, hs256, claims(map[string]any{"role": "admin"})), ".")[1] + "." + strings.Split(valid, ".")[2], errInvalidToken},
+		{"jwks kid", v, sign(opsKey, map[string]any{"alg": "HS256", "kid": "ops"}, claims(nil)), nil},
+		{"jwks key without kid", v, sign(opsKey, hs256, claims(nil)), nil},
+		{"unknown kid", v, sign(opsKey, map[string]any{"alg": "HS256", "kid": "retired"}, claims(nil)), errInvalidToken},
+		{"kid with another key", v, sign(secret, map[string]any{"alg": "HS256", "kid": "ops"}, claims(nil)), errInvalidToken},
+		{"no exp", v, sign(secret, hs256, claims(map[string]any{"exp": nil})), errInvalidToken},
+		{"exp at the leeway edge", v, sign(secret, hs256, claims(map[string]any{"exp": now.Add(-leeway).Unix()})), nil},
+		{"exp past the leeway", v, sign(secret, hs256, claims(map[string]any{"exp": now.Add(-leeway - time.Second).Unix()})), errExpiredToken},
+		{"nbf at the leeway edge", v, sign(secret, hs256, claims(map[string]any{"nbf": now.Add(leeway).Unix()})), nil},
+		{"nbf past the leeway", v, sign(secret, hs256, claims(map[string]any{"nbf": now.Add(leeway + time.Second).Unix()})), errInvalidToken},
+		{"iss and aud unchecked", v, sign(secret, hs256, claims(map[string]any{"iss": "elsewhere", "aud": "other"})), nil},
+		{"iss and aud match", scoped, sign(secret, hs256, claims(map[string]any{"iss": "syncstream-api", "aud": "proxy"})), nil},
+		{"aud list", scoped, sign(secret, hs256, claims(map[string]any{"iss": "syncstream-api", "aud": []string{"api", "proxy"}})), nil},
+		{"wrong iss", scoped, sign(secret, hs256, claims(map[string]any{"iss": "elsewhere", "aud": "proxy"})), errInvalidToken},
+		{"wrong aud", scoped, sign(secret, hs256, claims(map[string]any{"iss": "syncstream-api", "aud": []string{"api"}})), errInvalidToken},
+		{"missing iss and aud", scoped, valid, errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.verifier.verify(tt.token, now)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("verify = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// Only API session tokens authenticate: profile selection tokens carry a
+// userId too but must not
+func TestAuthenticateTokenKinds(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.Auth.Secret = "sek" })
+	exp := time.Now().Add(time.Hour).Unix()
+	hs256 := map[string]any{"alg": "HS256"}
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   error
+		userID string
+	}{
+		{"session token", map[string]any{"userId": 7, "email": "a@example.com", "exp": exp}, nil, "7"},
+		{"sub instead of userId", map[string]any{"sub": "ops-alice", "role": "admin", "exp": exp}, nil, "ops-alice"},
+		{"profile token", map[string]any{"userId": 7, "profileId": 3, "type": "profile", "exp": exp}, errInvalidToken, ""},
+		{"no subject", map[string]any{"email": "a@example.com", "exp": exp}, errInvalidToken, ""},
+		{"unknown role", map[string]any{"userId": 7, "role": "root", "exp": exp}, errInvalidToken, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/get", nil)
+			r.Header.Set("Authorization", "Bearer "+signHS256(t, "sek", hs256, tt.claims))
+			user, err := s.authenticate(r, s.current().verifier)
+			if !errors.Is(err, tt.want) || user.ID != tt.userID {
+				t.Errorf("authenticate = %+v, %v; want user %q, %v", user, err, tt.userID, tt.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/get", nil)
+	r.Header.Set("Authorization", "Basic YWxpY2U6c2VjcmV0")
+	if _, err := s.authenticate(r, s.current().verifier); !errors.Is(err, errMissingToken) {
+		t.Errorf("authenticate with Basic auth = %v, want %v", err, errMissingToken)
+	}
+}
+
+// The API's session tokens carry no role, so a role list would lock every
+// user out; the proxy refuses to start with one
+func TestAuthRolesRejected(t *testing.T) {
+	config := DefaultConfig()
+	config.Auth.Secret = "sek"
+	config.Auth.Roles = []string{"user"}
+	if err := joinLines(config.validate()); err == nil || !strings.Contains(err.Error(), "auth.roles") {
+		t.Errorf("validate with auth.roles = %v, want an auth.roles problem", err)
+	}
+
+	// Any valid session token gets through to the proxy routes
+	s := newTestServer(t, func(c *Config) { c.Auth.Secret = "sek" })
+	token := signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 7, "email": "a@example.com", "exp": time.Now().Add(time.Hour).Unix()})
+	r := httptest.NewRequest(http.MethodGet, "/get", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	if w := serve(s, r); w.Code != http.StatusBadRequest {
+		t.Errorf("/get with a session token and no credentials = %d, want 400: %s", w.Code, w.Body)
+	}
+}
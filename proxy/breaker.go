@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is wrapped by every error returned while a host's circuit is open
+var errCircuitOpen = errors.New("circuit open")
+
+// circuitOpenError reports which host is short-circuited and for how long
+type circuitOpenError struct {
+	host    string
+	retryIn time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("provider %s is unavailable (circuit open, retry in %v)", e.host, e.retryIn.Round(time.Second))
+}
+
+func (e *circuitOpenError) Unwrap() error { return errCircuitOpen }
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerOutcome is what an allowed attempt reports back to its breaker
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	outcomeIgnored // e.g. the client went away; says nothing about the host
+)
+
+// BreakerConfig tunes the per-host circuit breakers.
+// A FailureThreshold of 0 disables them.
+type BreakerConfig struct {
+	FailureThreshold int           // consecutive failures that open the circuit
+	CoolDown         time.Duration // how long the circuit stays open before probing
+	HalfOpenProbes   int           // concurrent trial requests allowed while half-open
+}
+
+// breakerSet holds one circuit breaker per upstream host
+type breakerSet struct {
+	mu     sync.Mutex
+	config BreakerConfig
+	hosts  map[string]*hostBreaker
+}
+
+type hostBreaker struct {
+	state     breakerState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	lastError string
+}
+
+// BreakerStatus is the externally visible state of one host's breaker
+type BreakerStatus struct {
+	Host      string `json:"host"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	OpenedAt  int64  `json:"openedAt,omitempty"`
+	RetryIn   int64  `json:"retryInMs,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+func newBreakerSet(config BreakerConfig) *breakerSet {
+	return &breakerSet{config: config, hosts: make(map[string]*hostBreaker)}
+}
+
+// allow admits an attempt against host, or fails fast with a
+// circuitOpenError. The returned func must be called with the outcome.
+func (b *breakerSet) allow(host string) (func(breakerOutcome), error) {
+	host = strings.ToLower(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.FailureThreshold <= 0 {
+		return func(breakerOutcome) {}, nil
+	}
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		b.prune()
+		hb = &hostBreaker{}
+		b.hosts[host] = hb
+	}
+
+	probe := false
+	switch hb.state {
+	case breakerOpen:
+		if wait := b.config.CoolDown - time.Since(hb.openedAt); wait > 0 {
+			return nil, &circuitOpenError{host: host, retryIn: wait}
+		}
+		hb.state = breakerHalfOpen
+		hb.probes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if hb.probes >= max(b.config.HalfOpenProbes, 1) {
+			return nil, &circuitOpenError{host: host, retryIn: 0}
+		}
+		hb.probes++
+		probe = true
+	}
+
+	return func(outcome breakerOutcome) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.record(hb, probe, outcome)
+	}, nil
+}
+
+// check fails fast with a circuitOpenError while host's circuit is open
+// and cooling down, without taking a probe. Callers still need allow.
+func (b *breakerSet) check(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hb, ok := b.hosts[strings.ToLower(host)]
+	if !ok || b.config.FailureThreshold <= 0 || hb.state != breakerOpen {
+		return nil
+	}
+	if wait := b.config.CoolDown - time.Since(hb.openedAt); wait > 0 {
+		return &circuitOpenError{host: strings.ToLower(host), retryIn: wait}
+	}
+	return nil
+}
+
+// setConfig applies new tuning on reload; tracked hosts keep their state
+func (b *breakerSet) setConfig(config BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config = config
+}
+
+// record applies an attempt outcome. Callers must hold b.mu.
+func (b *breakerSet) record(hb *hostBreaker, probe bool, outcome breakerOutcome) {
+	if probe {
+		hb.probes--
+	}
+
+	switch outcome {
+	case outcomeSuccess:
+		hb.state = breakerClosed
+		hb.failures = 0
+	case outcomeFailure:
+		hb.failures++
+		if hb.state == breakerHalfOpen || hb.failures >= b.config.FailureThreshold {
+			hb.state = breakerOpen
+			hb.openedAt = time.Now()
+		}
+	}
+}
+
+// noteError keeps the last failure message for the status route
+func (b *breakerSet) noteError(host, msg string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if hb, ok := b.hosts[strings.ToLower(host)]; ok {
+		hb.lastError = msg
+	}
+}
+
+// prune forgets healthy hosts once many are tracked. Callers must hold b.mu.
+func (b *breakerSet) prune() {
+	if len(b.hosts) < maxTrackedHosts {
+		return
+	}
+	for host, hb := range b.hosts {
+		if hb.state == breakerClosed && hb.failures == 0 {
+			delete(b.hosts, host)
+		}
+	}
+}
+
+// statuses returns every tracked breaker, sorted by host
+func (b *breakerSet) statuses() []BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := make([]BreakerStatus, 0, len(b.hosts))
+	for host, hb := range b.hosts {
+		status := BreakerStatus{
+			Host:      host,
+			State:     hb.state.String(),
+			Failures:  hb.failures,
+			LastError: hb.lastError,
+		}
+		if hb.state != breakerClosed {
+			status.OpenedAt = hb.openedAt.UnixMilli()
+			if wait := b.config.CoolDown - time.Since(hb.openedAt); wait > 0 && hb.state == breakerOpen {
+				status.RetryIn = wait.Milliseconds()
+			}
+		}
+		out = append(out, status)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Host < out[j].Host })
+	return out
+}
+
+// attemptOutcome classifies an upstream attempt for the breaker: transport
+// failures and 5xx count against the host, anything else shows it is up
+func attemptOutcome(resp *http.Response, err error) breakerOutcome {
+	switch {
+	case err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, errAddressBlocked)):
+		return outcomeIgnored
+	case err != nil:
+		return outcomeFailure
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return outcomeFailure
+	default:
+		return outcomeSuccess
+	}
+}
+
+// handleBreakers reports the state of every upstream circuit breaker
+func (s *Server) handleBreakers(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data: map[string]any{
+			"breakers": s.breakers.statuses(),
+		},
+	})
+}
+
+// writeCircuitOpen answers a request whose provider circuit is open,
+// serving the cached catalog when one exists for these credentials
+func (s *Server) writeCircuitOpen(w http.ResponseWriter, err error, cached *NormalizedData, lk cacheLookup) {
+	if cached != nil {
+		setCacheHeaders(w, lk)
+		s.writeJSON(w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Message: fmt.Sprintf("Serving cached catalog: %v", err),
+			Data:    cached,
+		})
+		return
+	}
+
+	var openErr *circuitOpenError
+	if errors.As(err, &openErr) && openErr.retryIn > 0 {
+		w.Header().Set("Retry-After", fmt.Sprint(int(openErr.retryIn.Seconds()+1)))
+	}
+	s.writeJSON(w, http.StatusServiceUnavailable, ProxyResponse{
+		Success: false,
+		Code:    "UPSTREAM_CIRCUIT_OPEN",
+		Message: err.Error(),
+		Data:    nil,
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimiterTimeoutsDoNotTripBreaker(t *testing.T) {
+	upstream, allow := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "[]")
+	})
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.Breaker = BreakerConfig{FailureThreshold: 2, CoolDown: time.Minute, HalfOpenProbes: 1}
+		c.UpstreamLimit = HostLimit{MaxConcurrent: 1, RequestsPerSecond: 1000, Burst: 1000}
+	})
+	host := mustHost(t, upstream.URL)
+	target := upstream.URL + "/player_api.php?username=alice&action=get_live_streams"
+
+	// Hold the host's only slot so every fetch times out in the proxy's queue
+	release, err := s.upstream.acquire(context.Background(), host, "someone-else")
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		_, err := s.fetchDecode(ctx, target, discard)
+		cancel()
+		if err == nil {
+			t.Fatalf("fetch %d succeeded while the limiter slot was held", i)
+		}
+	}
+
+	for _, status := range s.breakers.statuses() {
+		if status.State != "closed" || status.Failures != 0 {
+			t.Errorf("breaker for %s = %s with %d failures after limiter timeouts, want closed with 0", status.Host, status.State, status.Failures)
+		}
+	}
+	for _, status := range s.upstreamStatuses() {
+		if status.Failures != 0 {
+			t.Errorf("upstream %s recorded %d failures for limiter timeouts", status.Host, status.Failures)
+		}
+	}
+
+	release()
+	if _, err := s.fetchDecode(context.Background(), target, discard); err != nil {
+		t.Fatalf("fetch after the slot was freed: %v", err)
+	}
+}
+
+func TestBreakerOpensOnUpstreamFailures(t *testing.T) {
+	upstream, allow := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.MaxRetries = 0
+		c.Breaker = BreakerConfig{FailureThreshold: 2, CoolDown: time.Minute, HalfOpenProbes: 1}
+	})
+	target := upstream.URL + "/player_api.php?username=alice&action=get_live_streams"
+
+	for i := 0; i < 2; i++ {
+		s.fetchDecode(context.Background(), target, discard)
+	}
+	attempts, err := s.fetchDecode(context.Background(), target, discard)
+	if err == nil || len(attempts) != 1 || attempts[0].Reason != "circuit open" {
+		t.Fatalf("third fetch = %v %+v, want a circuit open failure", err, attempts)
+	}
+}
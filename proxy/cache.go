@@ -0,0 +1,408 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheStatus describes how a catalog response was produced.
+// Values follow the usual reverse proxy vocabulary.
+type cacheStatus string
+
+const (
+	cacheHit     cacheStatus = "HIT"     // every action was fresh
+	cacheStale   cacheStatus = "STALE"   // served stale, refreshing in the background
+	cacheExpired cacheStatus = "EXPIRED" // expired actions were refetched in the foreground
+	cacheMiss    cacheStatus = "MISS"    // nothing cached for this account
+	cacheBypass  cacheStatus = "BYPASS"  // client asked for cache=bypass
+)
+
+// catalogCache keeps the most recent catalog per provider account.
+// Freshness is tracked per action so categories can outlive stream lists.
+type catalogCache struct {
+	mu          sync.Mutex
+	maxEntries  int
+	ttls        map[string]time.Duration
+	staleWindow time.Duration
+	entries     map[string]*list.Element
+	lru         *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key        string
+	credential string // fingerprint of the password the catalog was fetched with
+	data       *NormalizedData
+	fetchedAt  map[string]time.Time // per job key
+	refreshing bool
+}
+
+// cacheLookup is the outcome of consulting the cache for one request
+type cacheLookup struct {
+	status    cacheStatus
+	data      *NormalizedData      // cached snapshot, nil on miss
+	fetchedAt map[string]time.Time // copy of the entry's action timestamps
+	refresh   map[string]bool      // jobs to fetch; nil means all
+}
+
+func newCatalogCache(maxEntries int, ttls map[string]time.Duration, staleWindow time.Duration) *catalogCache {
+	return &catalogCache{
+		maxEntries:  maxEntries,
+		ttls:        ttls,
+		staleWindow: staleWindow,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// setFreshness applies new TTLs and stale window on reload
+func (c *catalogCache) setFreshness(ttls map[string]time.Duration, staleWindow time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttls = ttls
+	c.staleWindow = staleWindow
+}
+
+// len returns the number of cached catalogs
+func (c *catalogCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// CacheEntryStatus is one cached catalog as /admin/cache shows it
+type CacheEntryStatus struct {
+	Key        string                  `json:"key"`
+	Host       string                  `json:"host"`
+	Username   string                  `json:"username"`
+	Refreshing bool                    `json:"refreshing"`
+	Items      map[string]int          `json:"items"`
+	Actions    map[string]ActionStatus `json:"actions"`
+}
+
+// ActionStatus is the freshness of one cached action
+type ActionStatus struct {
+	FetchedAt int64  `json:"fetchedAt"`
+	AgeMs     int64  `json:"ageMs"`
+	State     string `json:"state"` // fresh, stale or expired
+}
+
+// statuses lists the cached catalogs, most recently used first
+func (c *catalogCache) statuses(now time.Time) []CacheEntryStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := make([]CacheEntryStatus, 0, c.lru.Len())
+	for el := c.lru.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*cacheEntry)
+		base, username, _ := strings.Cut(entry.key, "|")
+		status := CacheEntryStatus{
+			Key:        entry.key,
+			Host:       providerHost(base),
+			Username:   username,
+			Refreshing: entry.refreshing,
+			Items: map[string]int{
+				"live":   entry.data.Statistics.TotalLive,
+				"vod":    entry.data.Statistics.TotalVOD,
+				"series": entry.data.Statistics.TotalSeries,
+			},
+			Actions: make(map[string]ActionStatus, len(entry.fetchedAt)),
+		}
+		for key, fetchedAt := range entry.fetchedAt {
+			action := ActionStatus{FetchedAt: fetchedAt.UnixMilli(), AgeMs: now.Sub(fetchedAt).Milliseconds(), State: "fresh"}
+			if stale, expired := c.age(entry, key, now); expired {
+				action.State = "expired"
+			} else if stale {
+				action.State = "stale"
+			}
+			status.Actions[key] = action
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// purge drops the entries whose key matches and returns how many went
+func (c *catalogCache) purge(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	purged := 0
+	for key, el := range c.entries {
+		if match(key) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// catalogCacheKey identifies a provider account. Coalescing, the cache and
+// snapshots all key on it, so spellings of a base URL that reach the same
+// panel share one entry.
+func catalogCacheKey(baseURL, username string) string {
+	return normalizeBaseURL(baseURL) + "|" + username
+}
+
+// lookup classifies the cached entry for key and works out which jobs are due.
+// Entries fetched with other credentials count as a miss.
+func (c *catalogCache) lookup(key, credential string, now time.Time) cacheLookup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok || el.Value.(*cacheEntry).credential != credential {
+		return cacheLookup{status: cacheMiss}
+	}
+	c.lru.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+
+	lk := cacheLookup{
+		status:    cacheHit,
+		data:      entry.data,
+		fetchedAt: make(map[string]time.Time, len(entry.fetchedAt)),
+		refresh:   make(map[string]bool),
+	}
+	for k, t := range entry.fetchedAt {
+		lk.fetchedAt[k] = t
+	}
+
+	expired := false
+	for _, sec := range catalogSections {
+		categoriesStale, categoriesExpired := c.age(entry, sec.categoriesKey, now)
+		streamsStale, streamsExpired := c.age(entry, sec.streamsKey, now)
+
+		// New categories mean the streams have to be regrouped as well
+		if categoriesStale {
+			lk.refresh[sec.categoriesKey] = true
+			lk.refresh[sec.streamsKey] = true
+		} else if streamsStale {
+			lk.refresh[sec.streamsKey] = true
+		}
+		expired = expired || categoriesExpired || streamsExpired
+	}
+
+	switch {
+	case len(lk.refresh) == 0:
+		lk.status = cacheHit
+	case expired:
+		lk.status = cacheExpired
+	default:
+		lk.status = cacheStale
+	}
+	return lk
+}
+
+// age reports whether an action is past its TTL and past the stale window.
+// Actions that never succeeded count as expired.
+func (c *catalogCache) age(entry *cacheEntry, key string, now time.Time) (stale, expired bool) {
+	fetchedAt, ok := entry.fetchedAt[key]
+	if !ok {
+		return true, true
+	}
+	age := now.Sub(fetchedAt)
+	ttl := c.ttls[key]
+	return age > ttl, age > ttl+c.staleWindow
+}
+
+// store records a catalog and its per-action timestamps, evicting the least
+// recently used entry when full
+func (c *catalogCache) store(key, credential string, data *NormalizedData, fetchedAt map[string]time.Time) {
+	if data == nil || len(fetchedAt) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.credential = credential
+		entry.data = data
+		entry.fetchedAt = fetchedAt
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, credential: credential, data: data, fetchedAt: fetchedAt})
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// peek returns whatever is cached for key regardless of age, as STALE.
+// Used when the provider cannot be reached at all.
+func (c *catalogCache) peek(key, credential string) cacheLookup {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok || el.Value.(*cacheEntry).credential != credential {
+		return cacheLookup{}
+	}
+	entry := el.Value.(*cacheEntry)
+	lk := cacheLookup{status: cacheStale, data: entry.data, fetchedAt: make(map[string]time.Time, len(entry.fetchedAt))}
+	for k, t := range entry.fetchedAt {
+		lk.fetchedAt[k] = t
+	}
+	return lk
+}
+
+// beginRefresh marks key as refreshing; false if a refresh is already running
+func (c *catalogCache) beginRefresh(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+func (c *catalogCache) endRefresh(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// mergeFetchedAt returns the timestamps after a fetch of the given jobs
+func (lk cacheLookup) mergeFetchedAt(fetched map[string]bool, now time.Time) map[string]time.Time {
+	merged := make(map[string]time.Time, len(catalogActions))
+	// Timestamps only carry over when the cached sections were reused
+	if lk.refresh != nil {
+		for k, t := range lk.fetchedAt {
+			merged[k] = t
+		}
+	}
+	for k := range fetched {
+		merged[k] = now
+	}
+	return merged
+}
+
+// oldestFetch returns how long ago the oldest action in the catalog was fetched
+func oldestFetch(fetchedAt map[string]time.Time, now time.Time) time.Duration {
+	var age time.Duration
+	for _, t := range fetchedAt {
+		if d := now.Sub(t); d > age {
+			age = d
+		}
+	}
+	return age
+}
+
+// loadCatalog serves a catalog from the cache when possible, otherwise fetches
+// the due actions and stores the result. The returned lookup carries the
+// status and timestamps for the response headers.
+func (s *Server) loadCatalog(ctx context.Context, baseURL, username, password string, userInfo XtreamUserInfo, bypass bool) (*NormalizedData, cacheLookup, error) {
+	if s.cache == nil {
+		res := s.fetchShared(ctx, baseURL, username, password, userInfo, cacheLookup{})
+		return res.data, cacheLookup{}, res.err
+	}
+
+	key := catalogCacheKey(baseURL, username)
+	lk := cacheLookup{status: cacheBypass}
+	if !bypass {
+		lk = s.cache.lookup(key, credentialFingerprint(password), time.Now())
+	}
+	s.metrics.cacheLookups.inc(string(lk.status))
+
+	switch lk.status {
+	case cacheHit:
+		return withUserInfo(lk.data, userInfo), lk, nil
+	case cacheStale:
+		if s.cache.beginRefresh(key) {
+			go s.refreshCatalog(key, baseURL, username, password, userInfo, lk)
+		}
+		return withUserInfo(lk.data, userInfo), lk, nil
+	}
+
+	// MISS, EXPIRED and BYPASS fetch in the foreground
+	res := s.fetchShared(ctx, baseURL, username, password, userInfo, lk)
+	lk.fetchedAt = res.fetchedAt
+	return res.data, lk, res.err
+}
+
+// fetchShared fetches the actions due in lk and stores the result, sharing
+// one upstream fetch between identical concurrent requests
+func (s *Server) fetchShared(ctx context.Context, baseURL, username, password string, userInfo XtreamUserInfo, lk cacheLookup) catalogFetch {
+	flightKey := catalogFlightKey(baseURL, username, password, lk.refresh)
+	res, shared, err := s.flights.do(ctx, flightKey, func(ctx context.Context) catalogFetch {
+		data, fetched, err := s.fetchAllData(ctx, baseURL, username, password, userInfo, lk.refresh, lk.data)
+		fetchedAt := lk.mergeFetchedAt(fetched, time.Now())
+		if s.cache != nil {
+			s.cache.store(catalogCacheKey(baseURL, username), credentialFingerprint(password), data, fetchedAt)
+		}
+		return catalogFetch{data: data, fetchedAt: fetchedAt, err: err}
+	})
+	if shared {
+		s.stats.coalescedRequests.Add(1)
+	}
+	if err != nil {
+		return catalogFetch{err: err}
+	}
+	if shared && res.data != nil {
+		res.data = withUserInfo(res.data, userInfo)
+	}
+	return res
+}
+
+// cachedFallback returns the cached catalog for an account whose provider
+// is unreachable, or a zero lookup when there is none
+func (s *Server) cachedFallback(baseURL, username, password string) (*NormalizedData, cacheLookup) {
+	if s.cache == nil {
+		return nil, cacheLookup{}
+	}
+	lk := s.cache.peek(catalogCacheKey(baseURL, username), credentialFingerprint(password))
+	return lk.data, lk
+}
+
+// refreshCatalog revalidates a stale entry without holding up the client
+func (s *Server) refreshCatalog(key, baseURL, username, password string, userInfo XtreamUserInfo, lk cacheLookup) {
+	defer s.cache.endRefresh(key)
+
+	// Same budget as a foreground fetch, detached from the client request
+	// but not from the server's lifetime
+	ctx, cancel := context.WithTimeout(s.workCtx, s.current().config.RefreshTimeout)
+	defer cancel()
+
+	data, fetched, err := s.fetchAllData(ctx, baseURL, username, password, userInfo, lk.refresh, lk.data)
+	if err != nil {
+		slog.Warn("Background refresh incomplete", "host", providerHost(baseURL), "error", err.Error())
+	}
+	s.cache.store(key, credentialFingerprint(password), data, lk.mergeFetchedAt(fetched, time.Now()))
+}
+
+// withUserInfo returns a shallow copy of a cached catalog with fresh user info
+func withUserInfo(data *NormalizedData, userInfo XtreamUserInfo) *NormalizedData {
+	copied := *data
+	copied.UserInfo = userInfo
+	return &copied
+}
+
+// setCacheHeaders reports cache status and age on a catalog response
+func setCacheHeaders(w http.ResponseWriter, lk cacheLookup) {
+	if lk.status == "" {
+		return
+	}
+	w.Header().Set("X-Cache-Status", string(lk.status))
+	age := oldestFetch(lk.fetchedAt, time.Now())
+	w.Header().Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// freshFor returns per-action TTLs of ttl for every catalog action
+func freshFor(ttl time.Duration) map[string]time.Duration {
+	ttls := make(map[string]time.Duration, len(catalogActions))
+	for key := range catalogActions {
+		ttls[key] = ttl
+	}
+	return ttls
+}
+
+// fetchedAll returns timestamps of at for every catalog action
+func fetchedAll(at time.Time) map[string]time.Time {
+	fetchedAt := make(map[string]time.Time, len(catalogActions))
+	for key := range catalogActions {
+		fetchedAt[key] = at
+	}
+	return fetchedAt
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newCatalogCache(2, freshFor(time.Hour), time.Hour)
+	now := time.Now()
+	for _, key := range []string{"a", "b"} {
+		c.store(key, "cred", &NormalizedData{}, fetchedAll(now))
+	}
+
+	// Reading a makes b the least recently used
+	if lk := c.lookup("a", "cred", now); lk.status != cacheHit {
+		t.Fatalf("lookup(a) = %s, want HIT", lk.status)
+	}
+	c.store("c", "cred", &NormalizedData{}, fetchedAll(now))
+
+	if c.len() != 2 {
+		t.Errorf("len = %d, want 2", c.len())
+	}
+	for key, want := range map[string]cacheStatus{"a": cacheHit, "b": cacheMiss, "c": cacheHit} {
+		if lk := c.lookup(key, "cred", now); lk.status != want {
+			t.Errorf("lookup(%s) = %s, want %s", key, lk.status, want)
+		}
+	}
+
+	// Storing over an entry refreshes its place instead of adding one
+	c.store("a", "cred", &NormalizedData{}, fetchedAll(now))
+	c.store("d", "cred", &NormalizedData{}, fetchedAll(now))
+	if lk := c.lookup("a", "cred", now); lk.status != cacheHit {
+		t.Errorf("lookup(a) after rewrite = %s, want HIT", lk.status)
+	}
+	if lk := c.lookup("c", "cred", now); lk.status != cacheMiss {
+		t.Errorf("lookup(c) = %s, want it evicted", lk.status)
+	}
+}
+
+func TestCacheFreshness(t *testing.T) {
+	c := newCatalogCache(8, freshFor(time.Minute), time.Hour)
+	fetched := time.Now()
+	c.store("k", "cred", &NormalizedData{}, fetchedAll(fetched))
+
+	tests := []struct {
+		name    string
+		after   time.Duration
+		status  cacheStatus
+		refresh int // jobs due
+	}{
+		{"within the TTL", 30 * time.Second, cacheHit, 0},
+		{"in the stale window", 30 * time.Minute, cacheStale, len(catalogActions)},
+		{"past the stale window", 2 * time.Hour, cacheExpired, len(catalogActions)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lk := c.lookup("k", "cred", fetched.Add(tt.after))
+			if lk.status != tt.status || len(lk.refresh) != tt.refresh {
+				t.Errorf("lookup = %s refreshing %v, want %s with %d jobs", lk.status, slices.Sorted(maps.Keys(lk.refresh)), tt.status, tt.refresh)
+			}
+			if lk.data == nil {
+				t.Error("cached data not returned")
+			}
+		})
+	}
+
+	if lk := c.lookup("k", "other", fetched); lk.status != cacheMiss {
+		t.Errorf("lookup with another credential = %s, want MISS", lk.status)
+	}
+
+	// A stale stream list is refetched alone; stale categories take their
+	// streams along
+	fetchedAt := fetchedAll(fetched)
+	fetchedAt["live_streams"] = fetched.Add(-10 * time.Minute)
+	fetchedAt["vod_categories"] = fetched.Add(-10 * time.Minute)
+	c.store("k", "cred", &NormalizedData{}, fetchedAt)
+	lk := c.lookup("k", "cred", fetched)
+	if got, want := slices.Sorted(maps.Keys(lk.refresh)), []string{"live_streams", "vod_categories", "vod_streams"}; !slices.Equal(got, want) {
+		t.Errorf("refresh = %q, want %q", got, want)
+	}
+	if lk.status != cacheStale {
+		t.Errorf("status = %s, want STALE", lk.status)
+	}
+}
+
+func TestStaleEntryRefreshedInBackground(t *testing.T) {
+	p, allow := newPanel(t)
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1}]`)
+	s := newTestServer(t, allow)
+	defaults := DefaultConfig()
+
+	if w := serve(s, catalogRequest(p.URL, "")); w.Code != http.StatusOK || w.Header().Get("X-Cache-Status") != "MISS" {
+		t.Fatalf("first /get = %d %s, want 200 MISS", w.Code, w.Header().Get("X-Cache-Status"))
+	}
+
+	// Everything goes stale; the next request gets the old catalog at once
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1},{"name":"B","category_id":"1","stream_id":2}]`)
+	s.cache.setFreshness(freshFor(0), time.Hour)
+	w := serve(s, catalogRequest(p.URL, ""))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache-Status") != "STALE" {
+		t.Fatalf("stale /get = %d %s, want 200 STALE", w.Code, w.Header().Get("X-Cache-Status"))
+	}
+
+	key := catalogCacheKey(p.URL, "alice")
+	deadline := time.Now().Add(5 * time.Second)
+	for s.cache.peek(key, credentialFingerprint("secret")).data.Statistics.TotalLive != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the background refresh never replaced the stale entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.cache.setFreshness(defaults.CacheTTL, defaults.CacheStaleWindow)
+	w = serve(s, catalogRequest(p.URL, ""))
+	if got := w.Header().Get("X-Cache-Status"); got != "HIT" {
+		t.Errorf("/get after the refresh = %s, want HIT", got)
+	}
+	if got := p.requests("get_live_streams"); got != 2 {
+		t.Errorf("get_live_streams fetched %d times, want 2", got)
+	}
+}
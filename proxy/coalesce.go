@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flightGroup runs one call per key at a time and shares its result with
+// every caller that arrives while it is in flight
+type flightGroup[T any] struct {
+	mu      sync.Mutex
+	flights map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	val     T
+}
+
+func newFlightGroup[T any]() *flightGroup[T] {
+	return &flightGroup[T]{flights: make(map[string]*flight[T])}
+}
+
+// do calls fn once for concurrent callers with the same key. fn runs on a
+// context detached from any single caller, keeping the first caller's
+// deadline; it is cancelled only when every caller has given up. shared
+// reports whether the caller joined a flight started by someone else.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(context.Context) T) (val T, shared bool, err error) {
+	g.mu.Lock()
+	f, shared := g.flights[key]
+	if !shared {
+		var fctx context.Context
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			fctx, cancel = context.WithDeadline(context.WithoutCancel(ctx), deadline)
+		} else {
+			fctx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+		}
+
+		f = &flight[T]{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			defer cancel()
+			f.val = fn(fctx)
+
+			g.mu.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.val, shared, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Nobody is left to use the result; new callers start afresh
+			f.cancel()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+		}
+		g.mu.Unlock()
+		return val, shared, ctx.Err()
+	}
+}
+
+// catalogFetch is the shared outcome of a coalesced fetchAllData
+type catalogFetch struct {
+	data      *NormalizedData
+	fetchedAt map[string]time.Time
+	err       error
+}
+
+// catalogFlightKey identifies identical fetches: same provider, same
+// credentials and the same set of actions
+func catalogFlightKey(baseURL, username, password string, refresh map[string]bool) string {
+	actions := "all"
+	if refresh != nil {
+		keys := make([]string, 0, len(refresh))
+		for k := range refresh {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		actions = strings.Join(keys, ",")
+	}
+
+	return catalogCacheKey(baseURL, username) + "|" + credentialFingerprint(password) + "|" + actions
+}
+
+// fingerprintKey keys credential fingerprints. It is random per process so a
+// fingerprint seen in a heap dump or debug output cannot be brute-forced
+// offline against a password list.
+var fingerprintKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// credentialFingerprint identifies a password without keeping it around
+func credentialFingerprint(password string) string {
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// normalizeBaseURL reduces a provider base URL to scheme, host and path
+func normalizeBaseURL(baseURL string) string {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return strings.ToLower(baseURL)
+	}
+	path := strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/player_api.php")
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + strings.TrimSuffix(path, "/")
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForWaiters blocks until n callers wait on the flight for key
+func waitForWaiters[T any](t *testing.T, g *flightGroup[T], key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		f := g.flights[key]
+		joined := f != nil && f.waiters == n
+		g.mu.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d callers never joined the flight for %q", n, key)
+}
+
+func TestFlightSurvivesLeaderCancel(t *testing.T) {
+	g := newFlightGroup[int]()
+	started, release := make(chan context.Context, 1), make(chan struct{})
+	fn := func(ctx context.Context) int {
+		started <- ctx
+		<-release
+		return 42
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, _, err := g.do(leaderCtx, "k", fn)
+		leader <- err
+	}()
+	fctx := <-started
+
+	type result struct {
+		val    int
+		shared bool
+		err    error
+	}
+	follower := make(chan result, 1)
+	go func() {
+		val, shared, err := g.do(context.Background(), "k", fn)
+		follower <- result{val, shared, err}
+	}()
+	waitForWaiters(t, g, "k", 2)
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader error = %v, want context.Canceled", err)
+	}
+	if fctx.Err() != nil {
+		t.Fatal("the flight was cancelled while a follower still waited")
+	}
+
+	close(release)
+	got := <-follower
+	if got.err != nil || got.val != 42 || !got.shared {
+		t.Errorf("follower = %+v, want the leader's result, shared", got)
+	}
+}
+
+func TestFlightCancelledWhenEveryCallerLeft(t *testing.T) {
+	g := newFlightGroup[int]()
+	started := make(chan context.Context, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.do(ctx, "k", func(ctx context.Context) int {
+			started <- ctx
+			<-ctx.Done()
+			return 0
+		})
+	}()
+	fctx := <-started
+	cancel()
+	<-done
+
+	select {
+	case <-fctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flight kept running with nobody waiting")
+	}
+
+	// The next caller starts a new flight instead of joining the dead one
+	if _, shared, _ := g.do(context.Background(), "k", func(context.Context) int { return 1 }); shared {
+		t.Error("a new caller joined the abandoned flight")
+	}
+}
+
+func TestFlightSharesOneCall(t *testing.T) {
+	g := newFlightGroup[int]()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func(context.Context) int {
+		calls.Add(1)
+		<-release
+		return 7
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make([]int, callers)
+	sharedCount := atomic.Int32{}
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, shared, err := g.do(context.Background(), "k", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+			results[i] = val
+		}()
+	}
+	waitForWaiters(t, g, "k", callers)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("fn ran %d times, want 1", calls.Load())
+	}
+	if sharedCount.Load() != callers-1 {
+		t.Errorf("%d callers joined, want %d", sharedCount.Load(), callers-1)
+	}
+	for i, val := range results {
+		if val != 7 {
+			t.Errorf("caller %d got %d", i, val)
+		}
+	}
+}
+
+func TestIdenticalRequestsCoalesce(t *testing.T) {
+	p, allow := newPanel(t)
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1}]`)
+	entered, release := p.hold("get_live_streams")
+	defer release()
+	s := newTestServer(t, allow)
+
+	// Spellings of the same panel share one fetch
+	urls := []string{p.URL, p.URL + "/player_api.php"}
+	codes := make(chan int, len(urls))
+	for _, u := range urls {
+		go func() { codes <- serve(s, catalogRequest(u, "")).Code }()
+	}
+	<-entered
+	waitForWaiters(t, s.flights, catalogFlightKey(p.URL, "alice", "secret", nil), len(urls))
+	release()
+
+	for range urls {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("/get = %d", code)
+		}
+	}
+	if got := p.requests("get_live_streams"); got != 1 {
+		t.Errorf("get_live_streams fetched %d times, want 1", got)
+	}
+	if got := s.stats.coalescedRequests.Load(); got != 1 {
+		t.Errorf("coalesced requests = %d, want 1", got)
+	}
+}
+
+func TestCatalogKeys(t *testing.T) {
+	same := []string{"http://panel.example:8080", "http://Panel.Example:8080/", "panel.example:8080/player_api.php"}
+	for _, u := range same[1:] {
+		if got, want := catalogCacheKey(u, "alice"), catalogCacheKey(same[0], "alice"); got != want {
+			t.Errorf("cache key of %q = %q, want %q", u, got, want)
+		}
+		if got, want := catalogFlightKey(u, "alice", "pw", nil), catalogFlightKey(same[0], "alice", "pw", nil); got != want {
+			t.Errorf("flight key of %q = %q, want %q", u, got, want)
+		}
+	}
+	if catalogCacheKey("http://panel.example/a", "alice") == catalogCacheKey("http://panel.example/b", "alice") {
+		t.Error("panels under different paths share a key")
+	}
+	if credentialFingerprint("pw") != credentialFingerprint("pw") || credentialFingerprint("pw") == credentialFingerprint("pw2") {
+		t.Error("fingerprints do not identify passwords")
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting is one configuration value. The same key names it in the config
+// file (as a nested YAML path) and on the command line (--key); the
+// environment variable defaults to PROXY_ plus the upper-cased key.
+type setting struct {
+	key     string
+	env     string
+	usage   string
+	secret  bool // redacted by --print-config
+	restart bool // only read at startup; a reload reports it instead
+	field   func(c *Config) any
+}
+
+// durationEntry addresses one duration of a map-valued Config field
+type durationEntry struct {
+	m   map[string]time.Duration
+	key string
+}
+
+// settings lists every configurable value. Precedence, lowest first:
+// DefaultConfig, the config file, environment variables, flags.
+var settings = []setting{
+	{key: "server.addr", restart: true, env: "PROXY_ADDR", usage: "listen address", field: func(c *Config) any { return &c.Addr }},
+	{key: "server.metrics_addr", restart: true, usage: "listen address serving only /metrics, without auth; keep it off public networks", field: func(c *Config) any { return &c.MetricsAddr }},
+	{key: "server.read_timeout", restart: true, usage: "HTTP server read timeout", field: func(c *Config) any { return &c.ReadTimeout }},
+	{key: "server.write_timeout", restart: true, usage: "HTTP server write timeout", field: func(c *Config) any { return &c.WriteTimeout }},
+	{key: "server.idle_timeout", restart: true, usage: "HTTP server keep-alive idle timeout", field: func(c *Config) any { return &c.IdleTimeout }},
+	{key: "server.shutdown_timeout", usage: "time allowed for in-flight requests on shutdown", field: func(c *Config) any { return &c.ShutdownTimeout }},
+	{key: "server.drain_delay", usage: "how long /ready reports draining before shutdown stops accepting connections", field: func(c *Config) any { return &c.DrainDelay }},
+	{key: "server.max_concurrent", restart: true, usage: "concurrent /get and /test requests", field: func(c *Config) any { return &c.MaxConcurrent }},
+	{key: "pool.get.size", usage: "concurrent /get requests", field: func(c *Config) any { return &c.Pools["/get"].Size }},
+	{key: "pool.get.reserved", usage: "slots of server.max_concurrent kept for /get", field: func(c *Config) any { return &c.Pools["/get"].Reserved }},
+	{key: "pool.get.priority", usage: "order in which pools get freed slots, highest first", field: func(c *Config) any { return &c.Pools["/get"].Priority }},
+	{key: "pool.test.size", usage: "concurrent /test requests", field: func(c *Config) any { return &c.Pools["/test"].Size }},
+	{key: "pool.test.reserved", usage: "slots of server.max_concurrent kept for /test", field: func(c *Config) any { return &c.Pools["/test"].Reserved }},
+	{key: "pool.test.priority", usage: "order in which pools get freed slots, highest first", field: func(c *Config) any { return &c.Pools["/test"].Priority }},
+	{key: "server.queue_size", usage: "requests waiting for a slot, in arrival order, before new ones get 429 (0 disables the queue)", field: func(c *Config) any { return &c.QueueSize }},
+	{key: "server.queue_max_wait", usage: "longest a request waits for a slot before it gets 429", field: func(c *Config) any { return &c.QueueMaxWait }},
+	{key: "server.trusted_proxies", env: "PROXY_TRUSTED_PROXIES", usage: "CIDRs whose X-Forwarded-For is believed", field: func(c *Config) any { return &c.TrustedProxies }},
+
+	{key: "request.query_credentials", env: "PROXY_QUERY_CREDENTIALS", usage: "allow, deprecated or deny credentials in the query string", field: func(c *Config) any { return &c.QueryCredentials }},
+	{key: "request.test_timeout", usage: "deadline of /test", field: func(c *Config) any { return &c.TestTimeout }},
+	{key: "request.auth_timeout", usage: "deadline of the /get authentication step", field: func(c *Config) any { return &c.AuthTimeout }},
+	{key: "request.fetch_timeout", usage: "deadline of the /get catalog fetch", field: func(c *Config) any { return &c.FetchTimeout }},
+	{key: "request.refresh_timeout", usage: "deadline of a background catalog refresh", field: func(c *Config) any { return &c.RefreshTimeout }},
+
+	{key: "upstream.timeout", usage: "upstream request timeout, body included", field: func(c *Config) any { return &c.UpstreamTimeout }},
+	{key: "upstream.dial_timeout", usage: "upstream connect timeout", field: func(c *Config) any { return &c.UpstreamDialTimeout }},
+	{key: "upstream.keep_alive", usage: "upstream TCP keep-alive period", field: func(c *Config) any { return &c.UpstreamKeepAlive }},
+	{key: "upstream.max_idle_conns", usage: "idle upstream connections kept in total", field: func(c *Config) any { return &c.UpstreamMaxIdleConns }},
+	{key: "upstream.max_idle_conns_per_host", usage: "idle upstream connections kept per host", field: func(c *Config) any { return &c.UpstreamMaxIdleConnsPerHost }},
+	{key: "upstream.idle_conn_timeout", usage: "how long idle upstream connections are kept", field: func(c *Config) any { return &c.UpstreamIdleConnTimeout }},
+	{key: "upstream.max_concurrent", usage: "concurrent requests per provider host", field: func(c *Config) any { return &c.UpstreamLimit.MaxConcurrent }},
+	{key: "upstream.requests_per_second", usage: "request rate per provider host", field: func(c *Config) any { return &c.UpstreamLimit.RequestsPerSecond }},
+	{key: "upstream.burst", usage: "request burst per provider host", field: func(c *Config) any { return &c.UpstreamLimit.Burst }},
+	{key: "upstream.limits_file", env: "PROXY_UPSTREAM_LIMITS_FILE", usage: "JSON file of per-host limit overrides", field: func(c *Config) any { return &c.UpstreamLimitsFile }},
+
+	{key: "retry.max_retries", usage: "retries of a failed upstream request", field: func(c *Config) any { return &c.MaxRetries }},
+	{key: "retry.base_delay", usage: "base of the exponential backoff", field: func(c *Config) any { return &c.RetryDelay }},
+	{key: "retry.max_delay", usage: "cap of the exponential backoff", field: func(c *Config) any { return &c.RetryMaxDelay }},
+
+	{key: "breaker.failure_threshold", usage: "consecutive failures that open a host's circuit (0 disables)", field: func(c *Config) any { return &c.Breaker.FailureThreshold }},
+	{key: "breaker.cool_down", usage: "how long an open circuit waits before probing", field: func(c *Config) any { return &c.Breaker.CoolDown }},
+	{key: "breaker.half_open_probes", usage: "concurrent probes of a half-open circuit", field: func(c *Config) any { return &c.Breaker.HalfOpenProbes }},
+
+	{key: "cache.max_entries", restart: true, usage: "cached catalogs (0 disables the cache)", field: func(c *Config) any { return &c.CacheMaxEntries }},
+	{key: "cache.stale_window", usage: "how long an expired action may still be served", field: func(c *Config) any { return &c.CacheStaleWindow }},
+	{key: "cache.ttl.live_categories", usage: "freshness of live categories", field: func(c *Config) any { return durationEntry{c.CacheTTL, "live_categories"} }},
+	{key: "cache.ttl.vod_categories", usage: "freshness of VOD categories", field: func(c *Config) any { return durationEntry{c.CacheTTL, "vod_categories"} }},
+	{key: "cache.ttl.series_categories", usage: "freshness of series categories", field: func(c *Config) any { return durationEntry{c.CacheTTL, "series_categories"} }},
+	{key: "cache.ttl.live_streams", usage: "freshness of live streams", field: func(c *Config) any { return durationEntry{c.CacheTTL, "live_streams"} }},
+	{key: "cache.ttl.vod_streams", usage: "freshness of VOD streams", field: func(c *Config) any { return durationEntry{c.CacheTTL, "vod_streams"} }},
+	{key: "cache.ttl.series", usage: "freshness of series", field: func(c *Config) any { return durationEntry{c.CacheTTL, "series"} }},
+
+	{key: "snapshot.retention", restart: true, usage: "snapshots kept per account (0 disables since=)", field: func(c *Config) any { return &c.SnapshotRetention }},
+	{key: "snapshot.ttl", restart: true, usage: "how long a superseded snapshot stays usable", field: func(c *Config) any { return &c.SnapshotTTL }},
+	{key: "snapshot.max_accounts", restart: true, usage: "accounts with snapshots kept", field: func(c *Config) any { return &c.SnapshotMaxAccounts }},
+
+	{key: "auth.jwt_secret", env: "PROXY_JWT_SECRET", usage: "HS256 secret shared with the API", secret: true, field: func(c *Config) any { return &c.Auth.Secret }},
+	{key: "auth.jwks_file", env: "PROXY_JWKS_FILE", usage: "JWK set of HS256 keys", field: func(c *Config) any { return &c.Auth.JWKSFile }},
+	{key: "auth.roles", env: "PROXY_AUTH_ROLES", usage: "must be empty: the API's tokens carry no role", field: func(c *Config) any { return &c.Auth.Roles }},
+	{key: "auth.admin_roles", usage: "roles allowed on /admin (with admin_users empty too, any authenticated caller)", field: func(c *Config) any { return &c.Auth.AdminRoles }},
+	{key: "auth.admin_users", usage: "user ids allowed on /admin whatever their role", field: func(c *Config) any { return &c.Auth.AdminUsers }},
+	{key: "auth.leeway", usage: "clock skew tolerated on exp and nbf", field: func(c *Config) any { return &c.Auth.Leeway }},
+	{key: "auth.issuer", usage: "iss claim tokens must carry (empty skips the check)", field: func(c *Config) any { return &c.Auth.Issuer }},
+	{key: "auth.audience", usage: "aud entry tokens must carry (empty skips the check)", field: func(c *Config) any { return &c.Auth.Audience }},
+	{key: "admin.pprof", usage: "serve Go profiling endpoints under /admin/debug/pprof/", field: func(c *Config) any { return &c.Pprof }},
+
+	{key: "playlists.database_url", env: "PROXY_PLAYLIST_DATABASE_URL", usage: "Postgres URL of the API database", secret: true, field: func(c *Config) any { return &c.Playlists.DatabaseURL }},
+	{key: "playlists.callback_url", env: "PROXY_PLAYLIST_CALLBACK_URL", usage: "API playlist endpoint with {id}", field: func(c *Config) any { return &c.Playlists.CallbackURL }},
+	{key: "playlists.cache_ttl", usage: "how long a looked up playlist is reused", field: func(c *Config) any { return &c.Playlists.CacheTTL }},
+
+	{key: "egress.blocklist", env: "PROXY_EGRESS_BLOCKLIST", usage: `CIDRs upstream connections may not reach ("none" disables)`, field: func(c *Config) any { return &c.Egress.Blocked }},
+	{key: "egress.allowlist", env: "PROXY_EGRESS_ALLOWLIST", usage: "CIDRs exempt from the blocklist", field: func(c *Config) any { return &c.Egress.Allowed }},
+
+	{key: "cors.origins", env: "PROXY_CORS_ORIGINS", usage: "allowed origins, exact or https://*.example.com", field: func(c *Config) any { return &c.CORS.AllowedOrigins }},
+	{key: "cors.credentials", env: "PROXY_CORS_CREDENTIALS", usage: "send Access-Control-Allow-Credentials", field: func(c *Config) any { return &c.CORS.AllowCredentials }},
+	{key: "cors.methods", env: "PROXY_CORS_METHODS", usage: "methods allowed in preflights", field: func(c *Config) any { return &c.CORS.AllowedMethods }},
+	{key: "cors.headers", env: "PROXY_CORS_HEADERS", usage: "request headers allowed in preflights", field: func(c *Config) any { return &c.CORS.AllowedHeaders }},
+	{key: "cors.exposed_headers", env: "PROXY_CORS_EXPOSED_HEADERS", usage: "response headers browsers may read", field: func(c *Config) any { return &c.CORS.ExposedHeaders }},
+	{key: "cors.max_age", env: "PROXY_CORS_MAX_AGE", usage: "preflight cache duration", field: func(c *Config) any { return &c.CORS.MaxAge }},
+
+	{key: "rate_limit.get.ip", env: "PROXY_RATE_LIMIT_GET_IP", usage: "/get budget per client IP, <requests>/<window>[:<burst>] or off", field: func(c *Config) any { return &c.RateLimits["/get"].PerIP }},
+	{key: "rate_limit.get.user", env: "PROXY_RATE_LIMIT_GET_USER", usage: "/get budget per user", field: func(c *Config) any { return &c.RateLimits["/get"].PerUser }},
+	{key: "rate_limit.test.ip", env: "PROXY_RATE_LIMIT_TEST_IP", usage: "/test budget per client IP", field: func(c *Config) any { return &c.RateLimits["/test"].PerIP }},
+	{key: "rate_limit.test.user", env: "PROXY_RATE_LIMIT_TEST_USER", usage: "/test budget per user", field: func(c *Config) any { return &c.RateLimits["/test"].PerUser }},
+
+	{key: "log.level", usage: "debug, info, warn or error", field: func(c *Config) any { return &c.LogLevel }},
+	{key: "log.format", restart: true, usage: "json or text", field: func(c *Config) any { return &c.LogFormat }},
+
+	{key: "tracing.exporter", restart: true, usage: "none, stdout or otlp", field: func(c *Config) any { return &c.Tracing.Exporter }},
+	{key: "tracing.endpoint", restart: true, usage: "OTLP/HTTP traces endpoint of the collector", field: func(c *Config) any { return &c.Tracing.Endpoint }},
+	{key: "tracing.service_name", restart: true, usage: "service.name reported with every span", field: func(c *Config) any { return &c.Tracing.ServiceName }},
+	{key: "tracing.sample_ratio", restart: true, usage: "share of new traces recorded (0 to 1); sampled incoming traces are always kept", field: func(c *Config) any { return &c.Tracing.SampleRatio }},
+
+	{key: "ready.max_saturation", usage: "share of server.max_concurrent in use at which /ready fails (0 to 1)", field: func(c *Config) any { return &c.Ready.MaxSaturation }},
+	{key: "ready.canary_url", usage: "URL fetched through the upstream client to check the network; empty disables the canary", secret: true, field: func(c *Config) any { return &c.Ready.CanaryURL }},
+	{key: "ready.canary_interval", usage: "time between canary checks", field: func(c *Config) any { return &c.Ready.CanaryInterval }},
+	{key: "ready.canary_timeout", usage: "canary request timeout", field: func(c *Config) any { return &c.Ready.CanaryTimeout }},
+}
+
+// envName is the environment variable of s
+func (s setting) envName() string {
+	if s.env != "" {
+		return s.env
+	}
+	return "PROXY_" + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+// set parses value into the setting's field of c
+func (s setting) set(c *Config, value string) error {
+	value = strings.TrimSpace(value)
+	switch field := s.field(c).(type) {
+	case *string:
+		*field = value
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("want true or false, got %q", value)
+		}
+		*field = b
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("want an integer, got %q", value)
+		}
+		*field = n
+	case *float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("want a number, got %q", value)
+		}
+		*field = f
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf(`want a duration such as "30s" or "5m", got %q`, value)
+		}
+		*field = d
+	case durationEntry:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf(`want a duration such as "30s" or "5m", got %q`, value)
+		}
+		field.m[field.key] = d
+	case *[]string:
+		// "none" clears a list that has a non-empty default
+		if value == "none" {
+			*field = []string{}
+		} else {
+			*field = splitList(value)
+		}
+	case *ClientLimit:
+		limit, err := parseClientLimit(value)
+		if err != nil {
+			return err
+		}
+		*field = limit
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+// get returns the setting's current value in c, for --print-config
+func (s setting) get(c *Config) any {
+	switch field := s.field(c).(type) {
+	case *string:
+		return *field
+	case *bool:
+		return *field
+	case *int:
+		return *field
+	case *float64:
+		return *field
+	case *time.Duration:
+		return field.String()
+	case durationEntry:
+		return field.m[field.key].String()
+	case *[]string:
+		return *field
+	case *ClientLimit:
+		return field.String()
+	default:
+		return nil
+	}
+}
+
+// equal reports whether the setting has the same value in a and b
+func (s setting) equal(a, b *Config) bool {
+	return reflect.DeepEqual(s.get(a), s.get(b))
+}
+
+// copy sets the setting's field of dst to its value in src
+func (s setting) copy(dst, src *Config) {
+	switch field := s.field(dst).(type) {
+	case *string:
+		*field = *s.field(src).(*string)
+	case *bool:
+		*field = *s.field(src).(*bool)
+	case *int:
+		*field = *s.field(src).(*int)
+	case *float64:
+		*field = *s.field(src).(*float64)
+	case *time.Duration:
+		*field = *s.field(src).(*time.Duration)
+	case durationEntry:
+		from := s.field(src).(durationEntry)
+		field.m[field.key] = from.m[from.key]
+	case *[]string:
+		*field = slices.Clone(*s.field(src).(*[]string))
+	case *ClientLimit:
+		*field = *s.field(src).(*ClientLimit)
+	}
+}
+
+// LoadConfig builds the effective configuration from defaults, the config
+// file (--config or PROXY_CONFIG_FILE), the environment and args, then
+// validates it. printOnly reports --print-config.
+func LoadConfig(args []string, getenv func(string) string) (config *Config, printOnly bool, err error) {
+	config = DefaultConfig()
+
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	configFile := fs.String("config", getenv("PROXY_CONFIG_FILE"), "YAML config file")
+	fs.BoolVar(&printOnly, "print-config", false, "print the effective configuration, secrets redacted, and exit")
+
+	// Flags are only recorded here and applied last, after file and env
+	flagValues := make(map[string]string)
+	defaults := DefaultConfig()
+	for _, s := range settings {
+		usage := fmt.Sprintf("%s (env %s", s.usage, s.envName())
+		switch value := s.get(defaults).(type) {
+		case []string:
+			if len(value) > 0 {
+				usage += ", default " + strings.Join(value, ",")
+			}
+		case string:
+			if value != "" {
+				usage += ", default " + value
+			}
+		default:
+			usage += fmt.Sprintf(", default %v", value)
+		}
+		usage += ")"
+		fs.Func(s.key, usage, func(value string) error {
+			flagValues[s.key] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() > 0 {
+		return nil, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var problems []error
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, key := range sortedKeys(values) {
+			s, ok := settingByKey(key)
+			if !ok {
+				problems = append(problems, fmt.Errorf("%s: unknown setting %q", *configFile, key))
+				continue
+			}
+			if err := s.set(config, values[key]); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %s: %w", *configFile, key, err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value := getenv(s.envName()); value != "" {
+			if err := s.set(config, value); err != nil {
+				problems = append(problems, fmt.Errorf("env %s: %w", s.envName(), err))
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := flagValues[s.key]; ok {
+			if err := s.set(config, value); err != nil {
+				problems = append(problems, fmt.Errorf("flag --%s: %w", s.key, err))
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		problems = append(problems, config.validate()...)
+	}
+	if len(problems) > 0 {
+		return nil, false, fmt.Errorf("invalid configuration:\n  %w", joinLines(problems))
+	}
+
+	if config.UpstreamLimitsFile != "" {
+		limits, err := loadHostLimits(config.UpstreamLimitsFile)
+		if err != nil {
+			return nil, false, err
+		}
+		config.UpstreamHostLimits = limits
+	}
+	return config, printOnly, nil
+}
+
+// readConfigFile flattens a YAML document into dotted keys, e.g.
+// {retry: {max_retries: 5}} becomes "retry.max_retries" = "5". Lists are
+// joined with commas.
+func readConfigFile(path string) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	var walk func(prefix string, node any) error
+	walk = func(prefix string, node any) error {
+		switch v := node.(type) {
+		case map[string]any:
+			for key, child := range v {
+				if err := walk(joinKey(prefix, key), child); err != nil {
+					return err
+				}
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix] = strings.Join(items, ",")
+		case nil:
+			// An empty key keeps its default
+		default:
+			values[prefix] = fmt.Sprint(v)
+		}
+		return nil
+	}
+	if err := walk("", doc); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func settingByKey(key string) (setting, bool) {
+	for _, s := range settings {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validate reports every out-of-range value, named by its setting key
+func (c *Config) validate() []error {
+	var problems []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+		}
+	}
+
+	check(c.Addr != "", "server.addr", "must not be empty")
+	check(c.MetricsAddr != c.Addr, "server.metrics_addr", "must differ from server.addr")
+	check(c.MaxConcurrent > 0, "server.max_concurrent", "must be positive, got %d", c.MaxConcurrent)
+	reserved := 0
+	for _, route := range []string{"/get", "/test"} {
+		p, key := c.Pools[route], "pool"+strings.ReplaceAll(route, "/", ".")
+		check(p.Size > 0, key+".size", "must be positive, got %d", p.Size)
+		check(p.Reserved >= 0 && p.Reserved <= p.Size, key+".reserved", "must be between 0 and %s.size (%d), got %d", key, p.Size, p.Reserved)
+		reserved += p.Reserved
+	}
+	check(reserved <= c.MaxConcurrent, "pool", "reserved slots (%d) exceed server.max_concurrent (%d)", reserved, c.MaxConcurrent)
+	check(c.QueueSize >= 0, "server.queue_size", "must not be negative, got %d", c.QueueSize)
+	check(slices.Contains([]string{queryCredentialsAllow, queryCredentialsDeprecated, queryCredentialsDeny}, c.QueryCredentials),
+		"request.query_credentials", `must be "allow", "deprecated" or "deny", got %q`, c.QueryCredentials)
+	check(c.MaxRetries >= 0, "retry.max_retries", "must not be negative, got %d", c.MaxRetries)
+	check(c.RetryDelay > 0, "retry.base_delay", "must be positive, got %v", c.RetryDelay)
+	check(c.RetryMaxDelay >= c.RetryDelay, "retry.max_delay", "must be at least retry.base_delay (%v), got %v", c.RetryDelay, c.RetryMaxDelay)
+	check(c.Breaker.FailureThreshold >= 0, "breaker.failure_threshold", "must not be negative, got %d", c.Breaker.FailureThreshold)
+	check(c.UpstreamLimit.MaxConcurrent >= 0 && c.UpstreamLimit.RequestsPerSecond >= 0 && c.UpstreamLimit.Burst >= 0,
+		"upstream", "max_concurrent, requests_per_second and burst must not be negative")
+	check(c.CacheMaxEntries >= 0, "cache.max_entries", "must not be negative, got %d", c.CacheMaxEntries)
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		check(false, "log.level", "%v", err)
+	}
+	check(c.LogFormat == logFormatJSON || c.LogFormat == logFormatText, "log.format", `must be "json" or "text", got %q`, c.LogFormat)
+	check(slices.Contains([]string{tracingNone, tracingStdout, tracingOTLP}, c.Tracing.Exporter),
+		"tracing.exporter", `must be "none", "stdout" or "otlp", got %q`, c.Tracing.Exporter)
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	if c.Tracing.Exporter == tracingOTLP {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "tracing.endpoint", "must be an http(s) URL, got %q", c.Tracing.Endpoint)
+	}
+	check(c.Ready.MaxSaturation > 0 && c.Ready.MaxSaturation <= 1, "ready.max_saturation", "must be above 0 and at most 1, got %v", c.Ready.MaxSaturation)
+	check(c.Ready.CanaryInterval > 0, "ready.canary_interval", "must be positive, got %v", c.Ready.CanaryInterval)
+	check(c.Ready.CanaryTimeout > 0, "ready.canary_timeout", "must be positive, got %v", c.Ready.CanaryTimeout)
+	if c.Ready.CanaryURL != "" {
+		u, err := url.Parse(c.Ready.CanaryURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "ready.canary_url", "must be an http(s) URL, got %q", redact(c.Ready.CanaryURL))
+	}
+	check(c.SnapshotRetention >= 0, "snapshot.retention", "must not be negative, got %d", c.SnapshotRetention)
+
+	for _, s := range settings {
+		switch field := s.field(c).(type) {
+		case *time.Duration:
+			check(*field >= 0, s.key, "must not be negative, got %v", *field)
+		case durationEntry:
+			check(field.m[field.key] > 0, s.key, "must be positive, got %v", field.m[field.key])
+		}
+	}
+	for _, key := range []string{"server.read_timeout", "server.write_timeout", "request.test_timeout",
+		"request.auth_timeout", "request.fetch_timeout", "request.refresh_timeout", "upstream.timeout"} {
+		s, _ := settingByKey(key)
+		d := *s.field(c).(*time.Duration)
+		check(d > 0, key, "must be positive, got %v", d)
+	}
+
+	// The API signs {userId, email} only: a role list would refuse every
+	// session token, so it is rejected rather than silently locking users out
+	check(len(c.Auth.Roles) == 0, "auth.roles", "must be empty: the API's tokens carry no role claim, got %s", strings.Join(c.Auth.Roles, ", "))
+	for _, role := range c.Auth.AdminRoles {
+		check(slices.Contains(knownRoles, role), "auth.admin_roles", "unknown role %q, want one of %s", role, strings.Join(knownRoles, ", "))
+	}
+	check(c.Playlists.DatabaseURL == "" || c.Playlists.CallbackURL == "",
+		"playlists", "set either database_url or callback_url, not both")
+	check((c.Playlists.DatabaseURL == "" && c.Playlists.CallbackURL == "") || c.Auth.enabled(),
+		"playlists", "playlist lookups require auth.jwt_secret or auth.jwks_file")
+	if _, err := newEgressPolicy(c.Egress); err != nil {
+		check(false, "egress", "%v", err)
+	}
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		check(false, "server.trusted_proxies", "%v", err)
+	}
+	if _, err := newCORSPolicy(c.CORS); err != nil {
+		check(false, "cors", "%v", err)
+	}
+	return problems
+}
+
+// joinLines joins errors one per line, indented under the headline
+func joinLines(errs []error) error {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return errors.New(strings.Join(lines, "\n  "))
+}
+
+// printConfig writes the effective configuration as YAML, secrets redacted
+func printConfig(w io.Writer, c *Config) error {
+	doc := make(map[string]any)
+	for _, s := range settings {
+		value := s.get(c)
+		if s.secret && value != "" {
+			value = redacted
+		}
+
+		node := doc
+		parts := strings.Split(s.key, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = make(map[string]any)
+				node[part] = child
+			}
+			node = child
+		}
+		node[parts[len(parts)-1]] = value
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
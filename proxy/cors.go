@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig is the cross-origin policy of the proxy routes
+type CORSConfig struct {
+	// AllowedOrigins lists exact origins ("https://app.example.com"),
+	// wildcard subdomains ("https://*.example.com") or "*" for any origin
+	AllowedOrigins   []string
+	AllowCredentials bool
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	MaxAge           time.Duration // how long browsers may cache a preflight
+}
+
+// corsPolicy is the parsed form of CORSConfig
+type corsPolicy struct {
+	anyOrigin   bool
+	exact       map[string]bool
+	wildcards   []wildcardOrigin
+	credentials bool
+	methods     string
+	headers     string
+	exposed     string
+	maxAge      string
+}
+
+// wildcardOrigin matches any subdomain of suffix, e.g. https://*.example.com
+// matches https://app.example.com but not https://example.com
+type wildcardOrigin struct {
+	scheme string
+	suffix string // ".example.com", or ".example.com:8443" with a port
+}
+
+func newCORSPolicy(config CORSConfig) (*corsPolicy, error) {
+	p := &corsPolicy{
+		exact:       make(map[string]bool),
+		credentials: config.AllowCredentials,
+		methods:     strings.Join(config.AllowedMethods, ", "),
+		headers:     strings.Join(config.AllowedHeaders, ", "),
+		exposed:     strings.Join(config.ExposedHeaders, ", "),
+	}
+	if config.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(config.MaxAge.Seconds()))
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(origin, "://")
+			p.wildcards = append(p.wildcards, wildcardOrigin{scheme: scheme, suffix: strings.TrimPrefix(host, "*")})
+		case strings.Contains(origin, "*"):
+			return nil, errors.New("invalid CORS origin " + origin + ": wildcards must be a leading *. subdomain")
+		default:
+			if _, err := url.Parse(origin); err != nil || !strings.Contains(origin, "://") {
+				return nil, errors.New("invalid CORS origin " + origin)
+			}
+			p.exact[origin] = true
+		}
+	}
+
+	// Echoing every origin with credentials would let any site act as the user
+	if p.anyOrigin && p.credentials {
+		return nil, errors.New(`CORS credentials cannot be combined with the "*" origin`)
+	}
+	return p, nil
+}
+
+// allows reports whether a request from origin may be served
+func (p *corsPolicy) allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, w := range p.wildcards {
+		if u.Scheme != w.scheme {
+			continue
+		}
+		// u.Host keeps the port, so it must match the entry as well
+		if strings.HasSuffix(u.Host, w.suffix) && len(u.Host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsEnforced lists the routes browsers call. A disallowed Origin is
+// refused there; elsewhere it only gets no CORS headers, so health checks
+// and scrapers that happen to send one keep working.
+var corsEnforced = map[string]bool{"/get": true, "/test": true}
+
+// Middleware for CORS headers
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := s.current().cors
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !p.anyOrigin {
+			w.Header().Add("Vary", "Origin")
+		}
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowed := origin != "" && p.allows(origin)
+		if origin != "" && !allowed && corsEnforced[r.URL.Path] {
+			s.writeJSON(w, http.StatusForbidden, ProxyResponse{
+				Success: false,
+				Code:    "CORS_ORIGIN_DENIED",
+				Message: "Origin not allowed",
+				Data:    nil,
+			})
+			return
+		}
+
+		if allowed {
+			if p.anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if p.exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", p.exposed)
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			if preflight && allowed {
+				w.Header().Set("Access-Control-Allow-Methods", p.methods)
+				w.Header().Set("Access-Control-Allow-Headers", p.headers)
+				if p.maxAge != "" {
+					w.Header().Set("Access-Control-Max-Age", p.maxAge)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
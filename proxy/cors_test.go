@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	p, err := newCORSPolicy(CORSConfig{AllowedOrigins: []string{"https://app.example.com/", "https://*.example.org", "http://*.local.test:8080"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"HTTPS://APP.EXAMPLE.COM", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false}, // the apex is not a subdomain
+		{"https://evilexample.org", false},
+		{"http://a.example.org", false},
+		{"http://a.local.test:8080", true},
+		{"http://a.local.test", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := p.allows(tt.origin); got != tt.want {
+			t.Errorf("allows(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+
+	for _, bad := range []CORSConfig{
+		{AllowedOrigins: []string{"https://app.*.com"}},
+		{AllowedOrigins: []string{"app.example.com"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+	} {
+		if _, err := newCORSPolicy(bad); err == nil {
+			t.Errorf("newCORSPolicy(%+v) accepted", bad)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.CORS.AllowedOrigins = []string{"https://app.example.com"}
+		c.CORS.AllowCredentials = true
+		c.CORS.ExposedHeaders = []string{"ETag", "X-Custom"}
+	})
+	request := func(method, path, origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		return serve(s, r)
+	}
+
+	w := request(http.MethodGet, "/health", "https://app.example.com")
+	h := w.Header()
+	if h.Get("Access-Control-Allow-Origin") != "https://app.example.com" || h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin got %v", h)
+	}
+	if got := h.Get("Access-Control-Expose-Headers"); got != "ETag, X-Custom" {
+		t.Errorf("Access-Control-Expose-Headers = %q, want the configured list", got)
+	}
+	if h.Get("Vary") != "Origin" {
+		t.Errorf("Vary = %q, want Origin", h.Get("Vary"))
+	}
+
+	// Browser routes refuse other origins; probes are answered without CORS headers
+	for _, path := range []string{"/get", "/test"} {
+		if w := request(http.MethodGet, path, "https://evil.example.com"); w.Code != http.StatusForbidden {
+			t.Errorf("%s from a disallowed origin = %d, want 403", path, w.Code)
+		}
+	}
+	for _, path := range []string{"/health", "/ready"} {
+		w := request(http.MethodGet, path, "https://evil.example.com")
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s from a disallowed origin = %d with %q", path, w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	w = request(http.MethodOptions, "/get", "https://app.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") == "" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight = %d %v", w.Code, w.Header())
+	}
+	w = request(http.MethodOptions, "/health", "https://evil.example.com")
+	if w.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("preflight from a disallowed origin was allowed: %v", w.Header())
+	}
+	if w := request(http.MethodGet, "/get", ""); w.Code == http.StatusForbidden {
+		t.Error("a request without Origin was refused")
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"slices"
+)
+
+// decodeFunc consumes a successful upstream response body
+type decodeFunc func(r io.Reader) error
+
+// flexString accepts any JSON scalar and keeps it as a string.
+// Providers are inconsistent about quoting ids, ratings and dates.
+type flexString string
+
+func (f *flexString) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	switch b[0] {
+	case '"':
+		// Fast path for the common case of a string without escapes
+		if bytes.IndexByte(b, '\\') < 0 {
+			*f = flexString(b[1 : len(b)-1])
+			return nil
+		}
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*f = flexString(s)
+	case 'n', 't', 'f', '{', '[':
+		// null, booleans and nested values carry no usable text
+		*f = ""
+	default:
+		// Numbers keep their literal representation
+		*f = flexString(b)
+	}
+	return nil
+}
+
+// upstreamCategory mirrors one element of the get_*_categories actions
+type upstreamCategory struct {
+	CategoryID   flexString `json:"category_id"`
+	CategoryName flexString `json:"category_name"`
+}
+
+// upstreamStream mirrors one element of the get_live_streams, get_vod_streams
+// and get_series actions, keeping only the fields we forward
+type upstreamStream struct {
+	Num         any        `json:"num"`
+	Name        flexString `json:"name"`
+	CategoryID  flexString `json:"category_id"`
+	StreamIcon  flexString `json:"stream_icon"`
+	StreamType  flexString `json:"stream_type"`
+	StreamID    any        `json:"stream_id"`
+	SeriesID    any        `json:"series_id"`
+	Added       flexString `json:"added"`
+	Rating      flexString `json:"rating"`
+	Cover       flexString `json:"cover"`
+	Plot        flexString `json:"plot"`
+	Cast        flexString `json:"cast"`
+	Director    flexString `json:"director"`
+	Genre       flexString `json:"genre"`
+	ReleaseDate flexString `json:"releaseDate"`
+}
+
+// decodeList walks a top-level JSON array token by token and decodes one
+// element at a time, so the whole list never sits in memory as generic maps.
+// A lone object is treated as a single-element list and null as an empty one.
+// Elements that are not objects are skipped.
+func decodeList[T any](r io.Reader, fn func(*T)) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(br)
+	dec.UseNumber() // Preserve number precision
+
+	switch first {
+	case '[':
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		for dec.More() {
+			var item T
+			if err := dec.Decode(&item); err != nil {
+				// The decoder has already consumed the offending value
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					continue
+				}
+				return err
+			}
+			fn(&item)
+		}
+		_, err := dec.Token()
+		return err
+	case '{':
+		var item T
+		if err := dec.Decode(&item); err != nil {
+			return err
+		}
+		fn(&item)
+		return nil
+	default:
+		// Still validate the payload, but there is nothing to emit
+		var discard any
+		return dec.Decode(&discard)
+	}
+}
+
+// peekNonSpace returns the first non-whitespace byte without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.Discard(1)
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// decodeCategories returns a decodeFunc that fills dst with valid categories,
+// sorted with compareCategories
+func decodeCategories(dst *[]CategoryInfo) decodeFunc {
+	return func(r io.Reader) error {
+		categories := []CategoryInfo{}
+		err := decodeList(r, func(c *upstreamCategory) {
+			// Only add if we have essential fields
+			if c.CategoryID != "" && c.CategoryName != "" {
+				categories = append(categories, CategoryInfo{
+					CategoryID:   string(c.CategoryID),
+					CategoryName: string(c.CategoryName),
+				})
+			}
+		})
+		if err != nil {
+			return err
+		}
+		// The order they were listed in is not content; keep it out of the ETag
+		slices.SortStableFunc(categories, compareCategories)
+		*dst = categories
+		return nil
+	}
+}
+
+// streamGrouper groups decoded streams by category id as they arrive.
+// Category names are resolved in build, once the category list is known.
+type streamGrouper struct {
+	streamType string
+	groups     map[string][]StreamInfo
+	order      []string // category ids in order of first appearance
+}
+
+func newStreamGrouper(streamType string) *streamGrouper {
+	return &streamGrouper{
+		streamType: streamType,
+		groups:     make(map[string][]StreamInfo),
+	}
+}
+
+// decode streams an upstream list straight into the grouper
+func (g *streamGrouper) decode(r io.Reader) error {
+	return decodeList(r, g.add)
+}
+
+func (g *streamGrouper) add(item *upstreamStream) {
+	// Only process if we have essential fields
+	if item.Name == "" {
+		return
+	}
+
+	stream := StreamInfo{
+		Num:        item.Num,
+		Name:       string(item.Name),
+		CategoryID: string(item.CategoryID),
+		StreamIcon: string(item.StreamIcon),
+		StreamType: string(item.StreamType),
+		StreamID:   item.StreamID,
+		SeriesID:   item.SeriesID,
+		Added:      string(item.Added),
+		Rating:     string(item.Rating),
+	}
+
+	// Add VOD/Series specific fields that actually exist
+	if g.streamType == "vod" || g.streamType == "series" {
+		stream.Cover = string(item.Cover)
+		stream.Plot = string(item.Plot)
+		stream.Cast = string(item.Cast)
+		stream.Director = string(item.Director)
+		stream.Genre = string(item.Genre)
+		stream.ReleaseDate = string(item.ReleaseDate)
+	}
+
+	streams, seen := g.groups[stream.CategoryID]
+	if !seen {
+		g.order = append(g.order, stream.CategoryID)
+	}
+	g.groups[stream.CategoryID] = append(streams, stream)
+}
+
+// build resolves category names and returns the grouped streams in the
+// order of categories, which decodeCategories has sorted, followed by an
+// "Uncategorized" group for unknown category ids. Streams within a group are
+// sorted so equal content always encodes the same.
+func (g *streamGrouper) build(categories []CategoryInfo) []CategoryWithStreams {
+	var result []CategoryWithStreams
+	known := make(map[string]bool, len(categories))
+
+	// Add categories that have streams
+	for _, cat := range categories {
+		known[cat.CategoryID] = true
+		streams := g.groups[cat.CategoryID]
+		if len(streams) == 0 {
+			continue
+		}
+		for i := range streams {
+			streams[i].CategoryName = cat.CategoryName
+		}
+		slices.SortStableFunc(streams, compareStreams)
+		result = append(result, CategoryWithStreams{
+			CategoryID:   cat.CategoryID,
+			CategoryName: cat.CategoryName,
+			Streams:      streams,
+			StreamCount:  len(streams),
+		})
+	}
+
+	// Add uncategorized streams if any
+	var uncategorized []StreamInfo
+	for _, id := range g.order {
+		if known[id] {
+			continue
+		}
+		for _, stream := range g.groups[id] {
+			stream.CategoryName = "Uncategorized"
+			uncategorized = append(uncategorized, stream)
+		}
+	}
+	if len(uncategorized) > 0 {
+		slices.SortStableFunc(uncategorized, compareStreams)
+		result = append(result, CategoryWithStreams{
+			CategoryID:   "uncategorized",
+			CategoryName: "Uncategorized",
+			Streams:      uncategorized,
+			StreamCount:  len(uncategorized),
+		})
+	}
+
+	return result
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// benchStreams is the catalog size of the benchmarks, a large provider
+const benchStreams = 200_000
+
+// catalogPayloads generates upstream responses by action for a catalog of
+// streams streams, split between live, VOD and series like a real panel
+func catalogPayloads(streams int) map[string][]byte {
+	sections := []struct {
+		categories, streams string
+		share               int // percent of the streams
+		categoryCount       int
+	}{
+		{"get_live_categories", "get_live_streams", 50, 400},
+		{"get_vod_categories", "get_vod_streams", 30, 300},
+		{"get_series_categories", "get_series", 20, 200},
+	}
+
+	payloads := make(map[string][]byte)
+	for _, sec := range sections {
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i := 0; i < sec.categoryCount; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(&buf, `{"category_id":"%d","category_name":"Category %d","parent_id":0}`, i+1, i+1)
+		}
+		buf.WriteByte(']')
+		payloads[sec.categories] = bytes.Clone(buf.Bytes())
+
+		buf.Reset()
+		buf.WriteByte('[')
+		n := streams * sec.share / 100
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			// Ids are numbers or strings depending on the panel; mix both
+			category := fmt.Sprint(i%(sec.categoryCount+10) + 1) // a few unknown ids land in Uncategorized
+			fmt.Fprintf(&buf, `{"num":%d,"name":"Stream %d","stream_type":"movie","stream_id":%d,"stream_icon":"http://img.example/%d.png",`+
+				`"epg_channel_id":null,"added":"1700000000","rating":%d.5,"category_id":"%s","custom_sid":"","tv_archive":0,`+
+				`"cover":"http://img.example/c%d.jpg","plot":"A plot with \"quotes\" and more text to make it realistic.","cast":"A, B","director":"C",`+
+				`"genre":"Drama","releaseDate":"2020-01-01","container_extension":"mkv"}`,
+				i+1, i, i+1, i, i%10, category, i)
+		}
+		buf.WriteByte(']')
+		payloads[sec.streams] = bytes.Clone(buf.Bytes())
+	}
+	return payloads
+}
+
+func BenchmarkDecodeList(b *testing.B) {
+	payloads := catalogPayloads(benchStreams)
+	var categories []CategoryInfo
+	if err := decodeCategories(&categories)(bytes.NewReader(payloads["get_vod_categories"])); err != nil {
+		b.Fatal(err)
+	}
+	streams := payloads["get_vod_streams"]
+
+	b.SetBytes(int64(len(streams)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g := newStreamGrouper("vod")
+		if err := g.decode(bytes.NewReader(streams)); err != nil {
+			b.Fatal(err)
+		}
+		if len(g.build(categories)) == 0 {
+			b.Fatal("no categories built")
+		}
+	}
+}
+
+// BenchmarkDecodeListAny is the baseline for BenchmarkDecodeList: the same
+// payload through json.Unmarshal into []any and grouped from the generic
+// maps, the way catalogs were decoded before the streaming decoder
+func BenchmarkDecodeListAny(b *testing.B) {
+	payloads := catalogPayloads(benchStreams)
+	var categories []CategoryInfo
+	if err := decodeCategories(&categories)(bytes.NewReader(payloads["get_vod_categories"])); err != nil {
+		b.Fatal(err)
+	}
+	streams := payloads["get_vod_streams"]
+
+	b.SetBytes(int64(len(streams)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var items []any
+		if err := json.Unmarshal(streams, &items); err != nil {
+			b.Fatal(err)
+		}
+		if len(groupAny(items, categories)) == 0 {
+			b.Fatal("no categories built")
+		}
+	}
+}
+
+// groupAny groups generically decoded streams by category
+func groupAny(items []any, categories []CategoryInfo) []CategoryWithStreams {
+	str := func(m map[string]any, key string) string {
+		switch v := m[key].(type) {
+		case string:
+			return v
+		case float64:
+			return fmt.Sprintf("%.0f", v)
+		}
+		return ""
+	}
+
+	names := make(map[string]string, len(categories))
+	groups := make(map[string][]StreamInfo, len(categories)+1)
+	for _, cat := range categories {
+		names[cat.CategoryID] = cat.CategoryName
+	}
+	for _, item := range items {
+		m, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		stream := StreamInfo{
+			Num: m["num"], Name: str(m, "name"), CategoryID: str(m, "category_id"),
+			StreamIcon: str(m, "stream_icon"), StreamType: str(m, "stream_type"),
+			StreamID: m["stream_id"], SeriesID: m["series_id"], Added: str(m, "added"), Rating: str(m, "rating"),
+			Cover: str(m, "cover"), Plot: str(m, "plot"), Cast: str(m, "cast"), Director: str(m, "director"),
+			Genre: str(m, "genre"), ReleaseDate: str(m, "releaseDate"),
+		}
+		if stream.Name == "" {
+			continue
+		}
+		id := stream.CategoryID
+		if name, ok := names[id]; ok {
+			stream.CategoryName = name
+		} else {
+			id, stream.CategoryName = "uncategorized", "Uncategorized"
+		}
+		groups[id] = append(groups[id], stream)
+	}
+
+	var result []CategoryWithStreams
+	for _, cat := range append(categories, CategoryInfo{"uncategorized", "Uncategorized"}) {
+		if streams := groups[cat.CategoryID]; len(streams) > 0 {
+			result = append(result, CategoryWithStreams{CategoryID: cat.CategoryID, CategoryName: cat.CategoryName, Streams: streams, StreamCount: len(streams)})
+		}
+	}
+	return result
+}
+
+func BenchmarkFetchAllData(b *testing.B) {
+	payloads := catalogPayloads(benchStreams)
+	upstream, allow := newUpstream(b, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payloads[r.URL.Query().Get("action")])
+	})
+	s := newTestServer(b, func(c *Config) {
+		allow(c)
+		c.UpstreamLimit = HostLimit{MaxConcurrent: 12, RequestsPerSecond: 1e6, Burst: 1e6}
+	})
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(prev) })
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, _, err := s.fetchAllData(context.Background(), upstream.URL, "alice", "secret", XtreamUserInfo{}, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if got := data.Statistics.TotalItems; got != benchStreams {
+			b.Fatalf("fetched %d streams, want %d", got, benchStreams)
+		}
+	}
+}
+
+// The same catalog listed in another order must digest, and so tag, the same
+func TestCatalogDigestIgnoresListingOrder(t *testing.T) {
+	build := func(categories, streams string) *NormalizedData {
+		var cats []CategoryInfo
+		if err := decodeCategories(&cats)(strings.NewReader(categories)); err != nil {
+			t.Fatal(err)
+		}
+		g := newStreamGrouper("live")
+		if err := g.decode(strings.NewReader(streams)); err != nil {
+			t.Fatal(err)
+		}
+		data := &NormalizedData{}
+		data.Categories.Live = cats
+		data.CategorizedStreams.Live = g.build(cats)
+		return data
+	}
+
+	a := build(`[{"category_id":"10","category_name":"Sports"},{"category_id":2,"category_name":"News"},{"category_id":"2","category_name":"Kids"}]`,
+		`[{"num":1,"name":"A","category_id":"10"},{"num":2,"name":"B","category_id":"2"},{"num":3,"name":"C","category_id":"99"}]`)
+	b := build(`[{"category_id":"2","category_name":"Kids"},{"category_id":"10","category_name":"Sports"},{"category_id":"2","category_name":"News"}]`,
+		`[{"num":3,"name":"C","category_id":"99"},{"num":2,"name":"B","category_id":"2"},{"num":1,"name":"A","category_id":"10"}]`)
+
+	if catalogDigest(a) != catalogDigest(b) {
+		t.Errorf("digest depends on listing order:\n%+v\n%+v", a.Categories.Live, b.Categories.Live)
+	}
+	var ids []string
+	for _, c := range a.Categories.Live {
+		ids = append(ids, c.CategoryID+" "+c.CategoryName)
+	}
+	if got, want := strings.Join(ids, ", "), "2 Kids, 2 News, 10 Sports"; got != want {
+		t.Errorf("categories = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// catalogDigest hashes the catalog content, leaving out FetchedAt and the
+// user info. The JSON encoding is streamed into the hash so large catalogs
+// are never buffered.
+func catalogDigest(data *NormalizedData) [sha256.Size]byte {
+	h := sha256.New()
+	encoder := json.NewEncoder(h)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(struct {
+		Categories         Categories
+		CategorizedStreams CategorizedStreams
+	}{data.Categories, data.CategorizedStreams})
+
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// catalogETag combines the catalog digest with the user info of this response
+func catalogETag(data *NormalizedData) string {
+	h := sha256.New()
+	h.Write(data.digest[:])
+	json.NewEncoder(h).Encode(data.UserInfo)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// deltaETag tags a delta from the snapshot since to data, so it never
+// matches the full catalog or a delta from another base
+func deltaETag(since string, data *NormalizedData) string {
+	h := sha256.New()
+	h.Write([]byte("delta:" + since + ":"))
+	h.Write(data.digest[:])
+	json.NewEncoder(h).Encode(data.UserInfo)
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// etagMatches implements the weak comparison If-None-Match asks for
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// compareCategories orders categories by id, numerically when both are
+// numbers, then by name, so providers that list them in varying order
+// still produce the same catalog
+func compareCategories(a, b CategoryInfo) int {
+	if c := compareLoose(a.CategoryID, b.CategoryID); c != 0 {
+		return c
+	}
+	return strings.Compare(a.CategoryName, b.CategoryName)
+}
+
+// compareStreams orders streams by their provider number, then by id and
+// name, so grouping yields the same order for the same content
+func compareStreams(a, b StreamInfo) int {
+	if c := compareLoose(a.Num, b.Num); c != 0 {
+		return c
+	}
+	if c := compareLoose(a.StreamID, b.StreamID); c != 0 {
+		return c
+	}
+	if c := compareLoose(a.SeriesID, b.SeriesID); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Name, b.Name)
+}
+
+// compareLoose compares decoded JSON scalars numerically when both sides
+// are numbers and lexically otherwise. Missing values sort last.
+func compareLoose(a, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		default:
+			return -1
+		}
+	}
+
+	as, bs := looseString(a), looseString(b)
+	af, aErr := strconv.ParseFloat(as, 64)
+	bf, bErr := strconv.ParseFloat(bs, 64)
+	if aErr == nil && bErr == nil {
+		return cmp.Compare(af, bf)
+	}
+	return strings.Compare(as, bs)
+}
+
+func looseString(v any) string {
+	switch x := v.(type) {
+	case json.Number:
+		return string(x)
+	case string:
+		return x
+	default:
+		return fmt.Sprint(x)
+	}
+}
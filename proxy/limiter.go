@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostLimit bounds outbound traffic to one upstream host.
+// Zero values disable the corresponding limit.
+type HostLimit struct {
+	MaxConcurrent     int     `json:"max_concurrent"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// loadHostLimits reads per-host overrides from a JSON object keyed by host
+// (optionally with port), e.g. {"provider.tv:8080": {"max_concurrent": 4}}
+func loadHostLimits(path string) (map[string]HostLimit, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var limits map[string]HostLimit
+	if err := json.Unmarshal(raw, &limits); err != nil {
+		return nil, fmt.Errorf("invalid host limits in %s: %w", path, err)
+	}
+
+	normalized := make(map[string]HostLimit, len(limits))
+	for host, limit := range limits {
+		if limit.MaxConcurrent < 0 || limit.RequestsPerSecond < 0 || limit.Burst < 0 {
+			return nil, fmt.Errorf("invalid host limits in %s: negative value for %s", path, host)
+		}
+		normalized[strings.ToLower(host)] = limit
+	}
+	return normalized, nil
+}
+
+// maxTrackedHosts bounds every per-host table: limiters, breakers and
+// upstream stats each start forgetting hosts beyond it
+const maxTrackedHosts = 1024
+
+// upstreamLimiter hands out per-host limiters, applying overrides by host
+type upstreamLimiter struct {
+	mu        sync.Mutex
+	defaults  HostLimit
+	overrides map[string]HostLimit
+	hosts     map[string]*hostLimiter
+}
+
+func newUpstreamLimiter(defaults HostLimit, overrides map[string]HostLimit) *upstreamLimiter {
+	return &upstreamLimiter{
+		defaults:  defaults,
+		overrides: overrides,
+		hosts:     make(map[string]*hostLimiter),
+	}
+}
+
+// acquire waits for a request slot on host for account. The returned
+// release func must be called once the upstream response is consumed.
+func (l *upstreamLimiter) acquire(ctx context.Context, host, account string) (func(), error) {
+	return l.host(host).acquire(ctx, account)
+}
+
+func (l *upstreamLimiter) host(host string) *hostLimiter {
+	host = strings.ToLower(host)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.hosts[host]; ok {
+		return h
+	}
+
+	if len(l.hosts) >= maxTrackedHosts {
+		for key, h := range l.hosts {
+			if h.idle() {
+				delete(l.hosts, key)
+			}
+		}
+	}
+
+	h := newHostLimiter(l.limitFor(host))
+	l.hosts[host] = h
+	return h
+}
+
+// setLimits applies new limits on reload. Known hosts switch over in place,
+// keeping their queues.
+func (l *upstreamLimiter) setLimits(defaults HostLimit, overrides map[string]HostLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.defaults = defaults
+	l.overrides = overrides
+	for host, h := range l.hosts {
+		h.setLimit(l.limitFor(host))
+	}
+}
+
+// limitFor matches overrides on host:port first, then on the bare hostname
+func (l *upstreamLimiter) limitFor(host string) HostLimit {
+	if limit, ok := l.overrides[host]; ok {
+		return limit
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		if limit, ok := l.overrides[name]; ok {
+			return limit
+		}
+	}
+	return l.defaults
+}
+
+// hostLimiter combines a concurrency cap with a token bucket. Waiting
+// requests are queued per account and served round-robin, so one account's
+// burst of jobs cannot starve everyone else on the same provider.
+type hostLimiter struct {
+	mu     sync.Mutex
+	limit  HostLimit
+	active int
+	tokens float64
+	last   time.Time
+	queues map[string][]*hostWaiter
+	order  []string // accounts with waiters, in service order
+	timer  *time.Timer
+}
+
+type hostWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newHostLimiter(limit HostLimit) *hostLimiter {
+	return &hostLimiter{
+		limit:  limit,
+		tokens: float64(max(limit.Burst, 1)),
+		last:   time.Now(),
+		queues: make(map[string][]*hostWaiter),
+	}
+}
+
+func (h *hostLimiter) setLimit(limit HostLimit) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.limit == limit {
+		return
+	}
+	h.limit = limit
+	h.tokens = min(h.tokens, float64(max(limit.Burst, 1)))
+	// A higher limit may free waiting requests right away
+	h.dispatch()
+}
+
+func (h *hostLimiter) acquire(ctx context.Context, account string) (func(), error) {
+	h.mu.Lock()
+	if len(h.order) == 0 && h.hasSlot() && h.takeToken(time.Now()) {
+		h.active++
+		h.mu.Unlock()
+		return h.release, nil
+	}
+
+	w := &hostWaiter{ready: make(chan struct{})}
+	if len(h.queues[account]) == 0 {
+		h.order = append(h.order, account)
+	}
+	h.queues[account] = append(h.queues[account], w)
+	h.dispatch()
+	h.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return h.release, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if w.granted {
+			// Lost the race with dispatch; hand the slot on
+			h.active--
+			h.dispatch()
+		} else {
+			h.remove(account, w)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (h *hostLimiter) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active--
+	h.dispatch()
+}
+
+// dispatch grants queued requests while slots and tokens allow.
+// Callers must hold h.mu.
+func (h *hostLimiter) dispatch() {
+	for len(h.order) > 0 && h.hasSlot() {
+		now := time.Now()
+		if !h.takeToken(now) {
+			h.scheduleDispatch()
+			return
+		}
+
+		account := h.order[0]
+		queue := h.queues[account]
+		w := queue[0]
+		if len(queue) == 1 {
+			delete(h.queues, account)
+			h.order = h.order[1:]
+		} else {
+			h.queues[account] = queue[1:]
+			h.order = append(h.order[1:], account)
+		}
+
+		w.granted = true
+		h.active++
+		close(w.ready)
+	}
+}
+
+// scheduleDispatch wakes the queue once the next token is due
+func (h *hostLimiter) scheduleDispatch() {
+	if h.timer != nil {
+		return
+	}
+	wait := time.Duration((1 - h.tokens) / h.limit.RequestsPerSecond * float64(time.Second))
+	h.timer = time.AfterFunc(wait, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.timer = nil
+		h.dispatch()
+	})
+}
+
+func (h *hostLimiter) hasSlot() bool {
+	return h.limit.MaxConcurrent <= 0 || h.active < h.limit.MaxConcurrent
+}
+
+// takeToken refills the bucket and consumes one token if available
+func (h *hostLimiter) takeToken(now time.Time) bool {
+	if h.limit.RequestsPerSecond <= 0 {
+		return true
+	}
+
+	burst := float64(max(h.limit.Burst, 1))
+	h.tokens = min(burst, h.tokens+now.Sub(h.last).Seconds()*h.limit.RequestsPerSecond)
+	h.last = now
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+func (h *hostLimiter) remove(account string, w *hostWaiter) {
+	queue := h.queues[account]
+	for i, queued := range queue {
+		if queued == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		h.queues[account] = queue
+		return
+	}
+
+	delete(h.queues, account)
+	for i, a := range h.order {
+		if a == account {
+			h.order = append(h.order[:i], h.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (h *hostLimiter) idle() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.active == 0 && len(h.order) == 0 && h.timer == nil
+}
+
+// releaseOnClose gives a limiter slot back when the response body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queued returns how many requests wait on h
+func (h *hostLimiter) queued() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for _, queue := range h.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+func TestHostLimiterRoundRobin(t *testing.T) {
+	h := newHostLimiter(HostLimit{MaxConcurrent: 1})
+	ctx := context.Background()
+	release, err := h.acquire(ctx, "busy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	// a queues three jobs before b and c queue one each
+	for _, account := range []string{"a", "a", "a", "b", "c"} {
+		n := h.queued()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := h.acquire(ctx, account)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, account)
+			mu.Unlock()
+			done()
+		}()
+		for h.queued() == n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	wg.Wait()
+
+	if want := []string{"a", "b", "c", "a", "a"}; !slices.Equal(order, want) {
+		t.Errorf("served %q, want %q", order, want)
+	}
+}
+
+func TestHostLimiterTokenBucket(t *testing.T) {
+	h := newHostLimiter(HostLimit{RequestsPerSecond: 10, Burst: 2})
+	start := time.Now()
+	h.last = start
+
+	for i, want := range []bool{true, true, false} {
+		if got := h.takeToken(start); got != want {
+			t.Errorf("token %d at start = %v, want %v", i, got, want)
+		}
+	}
+	// One token comes back every 100ms, never more than the burst
+	if !h.takeToken(start.Add(100*time.Millisecond)) || h.takeToken(start.Add(100*time.Millisecond)) {
+		t.Error("bucket did not refill exactly one token after 100ms")
+	}
+	if !h.takeToken(start.Add(time.Hour)) || !h.takeToken(start.Add(time.Hour)) || h.takeToken(start.Add(time.Hour)) {
+		t.Error("bucket refilled beyond its burst")
+	}
+
+	// A request without a token waits for the next one
+	h = newHostLimiter(HostLimit{RequestsPerSecond: 20, Burst: 1})
+	ctx := context.Background()
+	if _, err := h.acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	began := time.Now()
+	if _, err := h.acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(began); waited < 30*time.Millisecond {
+		t.Errorf("second request waited %v, want about 50ms", waited)
+	}
+
+	// A caller that gives up leaves the queue
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	h = newHostLimiter(HostLimit{RequestsPerSecond: 0.001, Burst: 1})
+	h.acquire(context.Background(), "a")
+	if _, err := h.acquire(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire = %v, want the deadline", err)
+	}
+	if n := h.queued(); n != 0 {
+		t.Errorf("%d waiters left after cancellation", n)
+	}
+}
+
+func TestLoadHostLimits(t *testing.T) {
+	write := func(content string) string {
+		path := filepath.Join(t.TempDir(), "limits.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	limits, err := loadHostLimits(write(`{"Provider.TV:8080": {"max_concurrent": 4}, "provider.tv": {"max_concurrent": 2, "requests_per_second": 1.5, "burst": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := HostLimit{MaxConcurrent: 12}
+	l := newUpstreamLimiter(defaults, limits)
+	for host, want := range map[string]HostLimit{
+		"provider.tv:8080": {MaxConcurrent: 4},
+		"PROVIDER.tv:8080": {MaxConcurrent: 4},
+		"provider.tv:80":   {MaxConcurrent: 2, RequestsPerSecond: 1.5, Burst: 3},
+		"provider.tv":      {MaxConcurrent: 2, RequestsPerSecond: 1.5, Burst: 3},
+		"other.tv:8080":    defaults,
+	} {
+		if got := l.host(host).limit; got != want {
+			t.Errorf("limit for %s = %+v, want %+v", host, got, want)
+		}
+	}
+
+	// upstream.limits_file loads the same file into the configuration
+	config, _, err := LoadConfig([]string{"--upstream.limits_file", write(`{"Provider.TV": {"max_concurrent": 1}}`)}, envOf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := config.UpstreamHostLimits["provider.tv"]; got != (HostLimit{MaxConcurrent: 1}) {
+		t.Errorf("configured limit for provider.tv = %+v", got)
+	}
+
+	for name, content := range map[string]string{
+		"negative":  `{"provider.tv": {"burst": -1}}`,
+		"malformed": `{"provider.tv": {"max_concurrent": "four"}}`,
+	} {
+		if _, err := loadHostLimits(write(content)); err == nil || !strings.Contains(err.Error(), "invalid host limits") {
+			t.Errorf("%s file: error %v, want invalid host limits", name, err)
+		}
+	}
+	if _, err := loadHostLimits(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("a missing file loaded")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// logLevel is shared by every handler so a reload can change it in place
+var logLevel = new(slog.LevelVar)
+
+// newLogger writes lines in format at logLevel, through the credential filter
+func newLogger(w io.Writer, format string) *slog.Logger {
+	out := redactingWriter{w: w}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	if format == logFormatText {
+		return slog.New(slog.NewTextHandler(out, opts))
+	}
+	return slog.New(slog.NewJSONHandler(out, opts))
+}
+
+// parseLogLevel reads debug, info, warn or error
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("want debug, info, warn or error, got %q", value)
+	}
+	return level, nil
+}
+
+type loggerKey struct{}
+
+// logFor returns the logger of ctx, carrying the request ID and whatever
+// withLogAttrs added, or the default logger
+func logFor(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// withLogAttrs returns ctx whose logger adds args to every line
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logFor(ctx).With(args...))
+}
+
+// requestID returns the caller's X-Request-ID when it is safe to log and
+// echo, or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID(id) {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	return strings.IndexFunc(id, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c))
+	}) < 0
+}
+
+// ms expresses d in milliseconds for log attributes
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
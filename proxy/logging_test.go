@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends the default logger's JSON lines to the returned buffer
+// until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	logs := new(bytes.Buffer)
+	prevLogger, prevLevel := slog.Default(), logLevel.Level()
+	slog.SetDefault(newLogger(logs, logFormatJSON))
+	logLevel.Set(slog.LevelDebug)
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		logLevel.Set(prevLevel)
+	})
+	return logs
+}
+
+// logLines decodes the JSON log lines in logs
+func logLines(t *testing.T, logs *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestRequestLogLines(t *testing.T) {
+	const password = "hunter2-s3cret"
+	logs := captureLogs(t)
+
+	// A port nothing listens on, so the request logs upstream failures
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseURL := "http://" + ln.Addr().String()
+	ln.Close()
+
+	s := newTestServer(t, func(c *Config) {
+		c.Auth.Secret = "sek"
+		c.Egress.Allowed = []string{"127.0.0.1/32"}
+		c.MaxRetries = 1
+		c.RetryDelay = time.Millisecond
+	})
+	r := httptest.NewRequest(http.MethodGet, "/get", nil)
+	r.Header.Set("X-Request-ID", "req-123")
+	r.Header.Set("Authorization", "Bearer "+signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": 7, "exp": time.Now().Add(time.Hour).Unix()}))
+	r.Header.Set(headerBaseURL, baseURL)
+	r.Header.Set(headerUsername, "alice")
+	r.Header.Set(headerPassword, password)
+	w := serve(s, r)
+	if got := w.Header().Get("X-Request-ID"); got != "req-123" {
+		t.Errorf("X-Request-ID = %q, want the caller's", got)
+	}
+
+	lines := logLines(t, logs)
+	if len(lines) < 2 {
+		t.Fatalf("want handler lines and the access line, got:\n%s", logs)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "req-123" {
+			t.Errorf("line without the request id: %v", line)
+		}
+	}
+	access := lines[len(lines)-1]
+	if access["msg"] != "request" || access["path"] != "/get" || access["user_id"] != "7" {
+		t.Errorf("access line = %v, want /get with user_id 7", access)
+	}
+
+	// Everything went through the redactor on its way out
+	if strings.Contains(logs.String(), password) {
+		t.Errorf("password in the logs:\n%s", logs)
+	}
+	if !strings.Contains(logs.String(), "password="+redacted) {
+		t.Errorf("upstream URL not logged redacted:\n%s", logs)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	logs := captureLogs(t)
+	s := newTestServer(t, nil)
+
+	for _, id := range []string{"", "bad id\nwith a newline", strings.Repeat("x", 129)} {
+		logs.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := serve(s, r)
+		got := w.Header().Get("X-Request-ID")
+		if got == id || !validRequestID(got) || len(got) != 32 {
+			t.Errorf("X-Request-ID %q answered with %q, want a fresh id", id, got)
+		}
+		if lines := logLines(t, logs); lines[len(lines)-1]["request_id"] != got {
+			t.Errorf("access line request_id = %v, want %q", lines[len(lines)-1]["request_id"], got)
+		}
+	}
+}
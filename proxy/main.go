@@ -2,50 +2,213 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Configuration holds server configuration
+// Configuration holds server configuration. LoadConfig fills it from the
+// config file, environment and flags; see settings for every key.
 type Config struct {
-	Addr            string
-	ReadTimeout     time.Duration
-	WriteTimeout    time.Duration
-	IdleTimeout     time.Duration
-	ShutdownTimeout time.Duration
-	MaxConcurrent   int
-	MaxRetries      int
-	RetryDelay      time.Duration
+	Addr        string
+	MetricsAddr string // separate unauthenticated /metrics listener, off when empty
+	// QueryCredentials is "allow", "deprecated" or "deny" for credentials in the URL
+	QueryCredentials string
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	ShutdownTimeout  time.Duration
+	DrainDelay       time.Duration          // /ready reports draining this long before the listener closes
+	MaxConcurrent    int                    // across every pool
+	Pools            map[string]*PoolConfig // by route, within MaxConcurrent
+	QueueSize        int                    // requests waiting for a slot before 429s
+	QueueMaxWait     time.Duration          // longest wait for a slot
+	MaxRetries       int
+	RetryDelay       time.Duration // base of the exponential backoff
+	RetryMaxDelay    time.Duration
+
+	// Deadlines of the handler stages
+	TestTimeout    time.Duration // /test authentication
+	AuthTimeout    time.Duration // /get authentication
+	FetchTimeout   time.Duration // /get catalog fetch
+	RefreshTimeout time.Duration // background refresh of a stale catalog
+
+	// Upstream HTTP client
+	UpstreamTimeout             time.Duration // whole request, including the body
+	UpstreamDialTimeout         time.Duration
+	UpstreamKeepAlive           time.Duration
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleConnTimeout     time.Duration
+
+	Breaker BreakerConfig // per upstream host
+
+	Egress EgressConfig // addresses user-supplied base_urls may reach
+
+	// Per-client budgets by route, and the proxies whose X-Forwarded-For is believed
+	RateLimits     map[string]*RouteRateLimit
+	TrustedProxies []string
+
+	CORS CORSConfig
+
+	Auth AuthConfig // JWT authentication of /get, /test and /admin routes
+
+	Pprof bool // serve net/http/pprof under /admin/debug/pprof/
+
+	Playlists PlaylistConfig // credential source for playlist_id requests
+
+	// Outbound limits per upstream host, with per-host overrides
+	UpstreamLimit      HostLimit
+	UpstreamLimitsFile string // JSON overrides, loaded into UpstreamHostLimits
+	UpstreamHostLimits map[string]HostLimit
+
+	// Catalog cache; CacheMaxEntries of 0 disables it
+	CacheMaxEntries  int
+	CacheTTL         map[string]time.Duration // freshness per job key
+	CacheStaleWindow time.Duration            // how long past its TTL an action may still be served
+
+	// Delta sync snapshots; SnapshotRetention of 0 disables since=
+	SnapshotRetention   int           // snapshots kept per account
+	SnapshotTTL         time.Duration // how long a snapshot stays usable after it was last current
+	SnapshotMaxAccounts int
+
+	// Logging: level is debug, info, warn or error; format is json or text
+	LogLevel  string
+	LogFormat string
+
+	Tracing TracingConfig
+
+	Ready ReadyConfig
 }
 
 // DefaultConfig returns sensible defaults for production
 func DefaultConfig() *Config {
 	return &Config{
-		Addr:            getEnv("PROXY_ADDR", ":8081"),
-		ReadTimeout:     60 * time.Second,
-		WriteTimeout:    60 * time.Second, // Increased for large JSON payloads
-		IdleTimeout:     120 * time.Second,
-		ShutdownTimeout: 30 * time.Second,
-		MaxConcurrent:   500,
-		MaxRetries:      3, // Back to original for faster retries
-		RetryDelay:      2 * time.Second,
+		Addr:             ":8081",
+		QueryCredentials: queryCredentialsAllow,
+		ReadTimeout:      60 * time.Second,
+		WriteTimeout:     60 * time.Second, // Increased for large JSON payloads
+		IdleTimeout:      120 * time.Second,
+		ShutdownTimeout:  30 * time.Second,
+		MaxConcurrent:    500,
+		Pools: map[string]*PoolConfig{
+			"/get":  {Size: 500},
+			"/test": {Size: 100, Reserved: 20, Priority: 10}, // interactive signup checks
+		},
+		QueueSize:     100,
+		QueueMaxWait:  5 * time.Second,
+		MaxRetries:    3, // Back to original for faster retries
+		RetryDelay:    2 * time.Second,
+		RetryMaxDelay: 10 * time.Second,
+
+		TestTimeout:    5 * time.Second, // Use shorter timeout for test requests
+		AuthTimeout:    8 * time.Second,
+		FetchTimeout:   30 * time.Second, // Balanced timeout
+		RefreshTimeout: 30 * time.Second,
+
+		UpstreamTimeout:             15 * time.Second,
+		UpstreamDialTimeout:         5 * time.Second,
+		UpstreamKeepAlive:           30 * time.Second,
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: 10,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+
+		Breaker: BreakerConfig{FailureThreshold: 5, CoolDown: 30 * time.Second, HalfOpenProbes: 1},
+
+		CORS: CORSConfig{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", "If-None-Match", "X-Request-ID", "traceparent", "tracestate",
+				"X-Xtream-Base-URL", "X-Xtream-Username", "X-Xtream-Password"},
+			ExposedHeaders: []string{"ETag", "Age", "X-Cache-Status", "X-Snapshot-ID", "X-Request-ID",
+				"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After",
+				"X-Queue-Position", "X-Queue-Estimated-Wait"},
+			MaxAge: 10 * time.Minute,
+		},
+
+		RateLimits: map[string]*RouteRateLimit{
+			"/get": {
+				PerIP:   ClientLimit{Requests: 30, Window: time.Minute, Burst: 10},
+				PerUser: ClientLimit{Requests: 20, Window: time.Minute, Burst: 5},
+			},
+			"/test": {
+				PerIP:   ClientLimit{Requests: 60, Window: time.Minute, Burst: 20},
+				PerUser: ClientLimit{Requests: 30, Window: time.Minute, Burst: 10},
+			},
+		},
+
+		Egress: EgressConfig{Blocked: slices.Clone(defaultBlockedRanges)},
+
+		Auth: AuthConfig{AdminRoles: []string{"admin"}, Leeway: 30 * time.Second},
+
+		Playlists: PlaylistConfig{CacheTTL: time.Minute},
+
+		// A single /get fans out six requests; keep a provider from seeing all users at once
+		UpstreamLimit: HostLimit{MaxConcurrent: 12, RequestsPerSecond: 8, Burst: 16},
+
+		CacheMaxEntries: 64, // Catalogs can be tens of MB each
+		CacheTTL: map[string]time.Duration{
+			"live_categories":   6 * time.Hour, // Categories rarely change
+			"vod_categories":    6 * time.Hour,
+			"series_categories": 6 * time.Hour,
+			"live_streams":      10 * time.Minute,
+			"vod_streams":       30 * time.Minute,
+			"series":            30 * time.Minute,
+		},
+		CacheStaleWindow: time.Hour,
+
+		SnapshotRetention:   3,
+		SnapshotTTL:         24 * time.Hour,
+		SnapshotMaxAccounts: 256,
+
+		LogLevel:  "info",
+		LogFormat: logFormatJSON,
+
+		Tracing: TracingConfig{
+			Exporter:    tracingNone,
+			Endpoint:    "http://localhost:4318/v1/traces",
+			ServiceName: "syncstream-proxy",
+			SampleRatio: 1,
+		},
+
+		Ready: ReadyConfig{
+			MaxSaturation:  0.9,
+			CanaryInterval: 30 * time.Second,
+			CanaryTimeout:  5 * time.Second,
+		},
 	}
 }
 
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// splitList parses a comma separated value, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
-	return defaultValue
+	return items
 }
 
 // XtreamUserInfo represents user authentication info from Xtream
@@ -65,6 +228,7 @@ type XtreamWhoAmI struct {
 // ProxyResponse represents the standardized response format
 type ProxyResponse struct {
 	Success bool        `json:"success"`
+	Code    string      `json:"code,omitempty"` // machine-readable error code
 	Message string      `json:"message,omitempty"`
 	Data    interface{} `json:"data"`
 }
@@ -76,6 +240,9 @@ type NormalizedData struct {
 	CategorizedStreams CategorizedStreams `json:"categorizedStreams"` // Streams grouped by category
 	Statistics         Statistics         `json:"statistics"`
 	FetchedAt          int64              `json:"fetchedAt"`
+	SnapshotID         string             `json:"snapshotId,omitempty"` // pass back as since= for a delta
+
+	digest [sha256.Size]byte // content hash behind the ETag, see catalogDigest
 }
 
 type Statistics struct {
@@ -133,97 +300,241 @@ type StreamInfo struct {
 
 // Server wraps the HTTP server with configuration
 type Server struct {
-	config     *Config
-	httpServer *http.Server
-	client     *http.Client
-	semaphore  chan struct{}
+	rt            atomic.Pointer[runtime] // swapped by Reload
+	reloadMu      sync.Mutex
+	loadConfig    func() (*Config, error) // re-reads the config sources; nil disables reload
+	httpServer    *http.Server
+	metricsServer *http.Server // nil without server.metrics_addr
+	admission     *admission   // concurrency slots and wait queue of /get and /test
+	cache         *catalogCache
+	snapshots     *snapshotStore
+	flights       *flightGroup[catalogFetch]
+	upstream      *upstreamLimiter
+	breakers      *breakerSet
+	clients       *clientLimiter // per-IP and per-user budgets
+	stats         serverStats
+	metrics       *proxyMetrics
+	traces        *sdktrace.TracerProvider // nil when tracing is off
+	canary        canaryState
+	inflight      *inflightSet  // /get and /test requests, for /admin/requests
+	hostStats     *hostStatsSet // per provider host outcomes, for /admin/upstreams
+
+	// Lifecycle: workCtx parents every request and background refresh, and
+	// is cancelled when a drain runs out of time
+	workCtx    context.Context
+	cancelWork context.CancelFunc
+	draining   atomic.Bool
+	requests   sync.WaitGroup
+}
+
+// serverStats holds process-wide counters
+type serverStats struct {
+	coalescedRequests atomic.Int64 // /get requests that joined an identical in-flight fetch
 }
 
 // NewServer creates a new proxy server instance
-func NewServer(config *Config) *Server {
+func NewServer(config *Config) (*Server, error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %w", joinLines(problems))
+	}
 
-	// Create HTTP client with sensible defaults for upstream requests
-	client := &http.Client{
-		Timeout: 15 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
-			DisableKeepAlives:   false,
-			DialContext: (&net.Dialer{
-				Timeout:   5 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-		},
+	rt, err := newRuntime(config, nil)
+	if err != nil {
+		return nil, err
 	}
 
 	s := &Server{
-		config:    config,
-		client:    client,
-		semaphore: make(chan struct{}, config.MaxConcurrent),
+		admission: newAdmission(config.MaxConcurrent, config.Pools),
+		flights:   newFlightGroup[catalogFetch](),
+		upstream:  newUpstreamLimiter(config.UpstreamLimit, config.UpstreamHostLimits),
+		breakers:  newBreakerSet(config.Breaker),
+		clients:   newClientLimiter(),
+		metrics:   newProxyMetrics(),
+		inflight:  newInflightSet(),
+		hostStats: newHostStatsSet(),
+	}
+	if s.traces, err = newTracerProvider(config.Tracing); err != nil {
+		return nil, err
+	}
+	s.workCtx, s.cancelWork = context.WithCancel(context.Background())
+	s.rt.Store(rt)
+	go s.runCanary()
+
+	if config.CacheMaxEntries > 0 {
+		s.cache = newCatalogCache(config.CacheMaxEntries, config.CacheTTL, config.CacheStaleWindow)
+	}
+	if config.SnapshotRetention > 0 {
+		s.snapshots = newSnapshotStore(config.SnapshotRetention, config.SnapshotTTL, config.SnapshotMaxAccounts)
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/get", s.handleProxy)
-	mux.HandleFunc("/test", s.handleTest)
+	mux.HandleFunc("/get", s.rateLimitIP("/get", s.requireAuth(s.rateLimitUser("/get", s.trackInflight("/get", s.handleProxy)))))
+	mux.HandleFunc("/test", s.rateLimitIP("/test", s.requireAuth(s.rateLimitUser("/test", s.trackInflight("/test", s.handleTest)))))
 	mux.HandleFunc("/health", s.handleHealth)
+	mux.HandleFunc("/ready", s.handleReady)
+	// Provider hostnames in the labels are customer data: only admins read
+	// them here, scrapers use server.metrics_addr
+	mux.HandleFunc("/metrics", s.requireAdmin(s.handleMetrics))
+	mux.HandleFunc("/admin/breakers", s.requireAdmin(s.handleBreakers))
+	mux.HandleFunc("/admin/reload", s.requireAdmin(s.handleReload))
+	mux.HandleFunc("/admin/requests", s.requireAdmin(s.handleInflight))
+	mux.HandleFunc("/admin/requests/{id}", s.requireAdmin(s.handleCancelRequest))
+	mux.HandleFunc("/admin/upstreams", s.requireAdmin(s.handleUpstreams))
+	mux.HandleFunc("/admin/cache", s.requireAdmin(s.handleCache))
+	mux.HandleFunc("/admin/debug/pprof/", s.requireAdmin(s.handlePprof))
 
 	s.httpServer = &http.Server{
 		Addr:         config.Addr,
-		Handler:      s.loggingMiddleware(s.corsMiddleware(mux)),
+		Handler:      s.trackRequests(s.tracingMiddleware(mux, s.loggingMiddleware(s.metricsMiddleware(mux, s.corsMiddleware(mux))))),
 		ReadTimeout:  config.ReadTimeout,
 		WriteTimeout: config.WriteTimeout,
 		IdleTimeout:  config.IdleTimeout,
+		BaseContext:  func(net.Listener) context.Context { return s.workCtx },
+	}
+	if config.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("/metrics", s.handleMetrics)
+		s.metricsServer = &http.Server{
+			Addr:         config.MetricsAddr,
+			Handler:      metricsMux,
+			ReadTimeout:  config.ReadTimeout,
+			WriteTimeout: config.WriteTimeout,
+			IdleTimeout:  config.IdleTimeout,
+		}
 	}
 
-	return s
+	return s, nil
 }
 
-// Start starts the server
+// Start starts the server, and the metrics listener when configured. It
+// returns when either stops.
 func (s *Server) Start() error {
-	log.Printf("Starting proxy server on %s", s.config.Addr)
-	return s.httpServer.ListenAndServe()
+	stopped := make(chan error, 2)
+	if s.metricsServer != nil {
+		slog.Info("Serving metrics", "addr", s.metricsServer.Addr)
+		go func() { stopped <- s.metricsServer.ListenAndServe() }()
+	}
+	slog.Info("Starting proxy server", "addr", s.httpServer.Addr)
+	go func() { stopped <- s.httpServer.ListenAndServe() }()
+	return <-stopped
 }
 
-// Shutdown gracefully shuts down the server
+// drainGrace is how long cancelled requests get to unwind after the
+// shutdown timeout before their connections are closed
+const drainGrace = 2 * time.Second
+
+// Shutdown marks the server as draining, stops accepting connections and
+// waits for in-flight requests until ctx is done. Requests still running
+// then are cancelled, and ctx's error is returned.
 func (s *Server) Shutdown(ctx context.Context) error {
-	log.Println("Shutting down proxy server...")
-	return s.httpServer.Shutdown(ctx)
-}
+	slog.Info("Shutting down proxy server")
+	s.draining.Store(true)
+
+	// Give load balancers time to see /ready fail while still serving
+	if delay := s.current().config.DrainDelay; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
 
-// Middleware for CORS headers
-func (s *Server) corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	err := s.httpServer.Shutdown(ctx)
+	if s.metricsServer != nil {
+		// Scrapes are short and nothing waits on them
+		s.metricsServer.Close()
+	}
+	// Background refreshes are not worth waiting for either way
+	s.cancelWork()
+	defer s.flushSpans()
+	if err == nil {
+		return nil
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	slog.Warn("Shutdown timeout reached, cancelling in-flight requests")
+	done := make(chan struct{})
+	go func() {
+		s.requests.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainGrace):
+	}
+	s.httpServer.Close()
+	return err
+}
 
+// flushSpans exports the spans of the drained requests
+func (s *Server) flushSpans() {
+	if s.traces == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.traces.Shutdown(ctx); err != nil {
+		slog.Warn("Span export failed", "error", err.Error())
+	}
+}
+
+// trackRequests counts in-flight requests so a timed out drain can wait for
+// the cancelled ones to unwind
+func (s *Server) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		defer s.requests.Done()
 		next.ServeHTTP(w, r)
 	})
 }
 
-// Middleware for request logging
+// Middleware for request logging. Every request gets an X-Request-ID,
+// taken from the caller when valid, which tags all of its log lines.
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-ID", id)
 
 		// Wrap ResponseWriter to capture status code
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		entry := &requestLog{id: id}
+		ctx := withLogAttrs(context.WithValue(r.Context(), requestLogKey{}, entry), "request_id", id)
 
-		next.ServeHTTP(wrapped, r)
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
 
-		log.Printf("%s %s %d %v", r.Method, r.URL.Path, wrapped.statusCode, time.Since(start))
+		attrs := []any{"method", r.Method, "path", r.URL.Path, "status", wrapped.statusCode, "duration_ms", ms(time.Since(start))}
+		if entry.userID != "" {
+			attrs = append(attrs, "user_id", entry.userID)
+		}
+		logFor(ctx).Info("request", attrs...)
 	})
 }
 
+// requestLog collects details for the access log line from inner handlers
+type requestLog struct {
+	id     string
+	userID string
+}
+
+type requestLogKey struct{}
+
+// requestIDFrom returns the X-Request-ID of the request ctx belongs to
+func requestIDFrom(ctx context.Context) string {
+	if entry, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return entry.id
+	}
+	return ""
+}
+
+// setLogUser records the authenticated user on the request's log line
+func setLogUser(r *http.Request, userID string) {
+	if entry, ok := r.Context().Value(requestLogKey{}).(*requestLog); ok {
+		entry.userID = userID
+	}
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -234,70 +545,67 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// Health check endpoint
+// Health check endpoint: liveness only, see /ready for whether to route here
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	s.writeJSON(w, http.StatusOK, map[string]any{
 		"status": "healthy",
 		"time":   time.Now().Unix(),
+		"stats": map[string]any{
+			"coalescedRequests": s.stats.coalescedRequests.Load(),
+		},
 	})
 }
 
 // Test connection endpoint - lightweight credential validation
 func (s *Server) handleTest(w http.ResponseWriter, r *http.Request) {
-	// Limit concurrent requests
-	select {
-	case s.semaphore <- struct{}{}:
-		defer func() { <-s.semaphore }()
-	default:
-		s.writeJSON(w, http.StatusTooManyRequests, ProxyResponse{
-			Success: false,
-			Message: "Server too busy, please try again later",
-			Data:    nil,
-		})
-		return
-	}
-
 	ctx := r.Context()
-	baseURL := strings.TrimSpace(r.URL.Query().Get("base_url"))
-	username := strings.TrimSpace(r.URL.Query().Get("username"))
-	password := strings.TrimSpace(r.URL.Query().Get("password"))
-
-	if baseURL == "" || username == "" || password == "" {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: "Missing required parameters: base_url, username, password",
-			Data:    nil,
-		})
+	req, err := s.readProxyRequest(w, r)
+	if err != nil {
+		s.writeRequestError(w, err)
 		return
 	}
+	var authURL string
+	if req.PlaylistID == "" {
+		var ok bool
+		if authURL, ok = s.playerAuthURL(w, req); !ok {
+			return
+		}
+	}
 
-	// Validate base URL
-	if _, err := url.Parse(baseURL); err != nil {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: "Invalid base_url format",
-			Data:    nil,
-		})
+	// Limit concurrent requests, once the request is known to be valid
+	release, ok := s.admit(w, r, "/test")
+	if !ok {
 		return
 	}
+	defer release()
 
-	// Only authenticate - don't fetch all data
-	authURL, err := s.buildPlayerURL(baseURL, username, password, nil)
-	if err != nil {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to build auth URL: %v", err),
-			Data:    nil,
-		})
-		return
+	if req.PlaylistID != "" {
+		if err := s.resolvePlaylist(ctx, &req); err != nil {
+			s.writeRequestError(w, err)
+			return
+		}
+		if authURL, ok = s.playerAuthURL(w, req); !ok {
+			return
+		}
 	}
 
-	// Use shorter timeout for test requests
-	authCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	authCtx, cancel := context.WithTimeout(ctx, s.current().config.TestTimeout)
 	defer cancel()
 
 	var whoAmI XtreamWhoAmI
 	if err := s.fetchJSON(authCtx, authURL, &whoAmI); err != nil {
+		if cancelledByAdmin(ctx) {
+			s.writeCancelled(w)
+			return
+		}
+		if errors.Is(err, errCircuitOpen) {
+			s.writeCircuitOpen(w, err, nil, cacheLookup{})
+			return
+		}
+		if errors.Is(err, errAddressBlocked) {
+			s.writeAddressBlocked(w, err)
+			return
+		}
 		s.writeJSON(w, http.StatusUnauthorized, ProxyResponse{
 			Success: false,
 			Message: fmt.Sprintf("Authentication failed: %v", err),
@@ -328,59 +636,63 @@ func (s *Server) handleTest(w http.ResponseWriter, r *http.Request) {
 
 // Main proxy handler with concurrency limiting
 func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
-	// Limit concurrent requests
-	select {
-	case s.semaphore <- struct{}{}:
-		defer func() { <-s.semaphore }()
-	default:
-		s.writeJSON(w, http.StatusTooManyRequests, ProxyResponse{
-			Success: false,
-			Message: "Server too busy, please try again later",
-			Data:    nil,
-		})
-		return
-	}
-
 	ctx := r.Context()
-	baseURL := strings.TrimSpace(r.URL.Query().Get("base_url"))
-	username := strings.TrimSpace(r.URL.Query().Get("username"))
-	password := strings.TrimSpace(r.URL.Query().Get("password"))
-
-	if baseURL == "" || username == "" || password == "" {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: "Missing required parameters: base_url, username, password",
-			Data:    nil,
-		})
+	req, err := s.readProxyRequest(w, r)
+	if err != nil {
+		s.writeRequestError(w, err)
 		return
 	}
+	var authURL string
+	if req.PlaylistID == "" {
+		var ok bool
+		if authURL, ok = s.playerAuthURL(w, req); !ok {
+			return
+		}
+	}
 
-	// Validate base URL
-	if _, err := url.Parse(baseURL); err != nil {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: "Invalid base_url format",
-			Data:    nil,
-		})
+	// Limit concurrent requests. The body has been read and checked by now,
+	// so a client that left while sending it or a malformed request never
+	// takes a place in the queue.
+	release, ok := s.admit(w, r, "/get")
+	if !ok {
 		return
 	}
+	defer release()
 
-	// Step 1: Authenticate
-	authURL, err := s.buildPlayerURL(baseURL, username, password, nil)
-	if err != nil {
-		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
-			Success: false,
-			Message: fmt.Sprintf("Failed to build auth URL: %v", err),
-			Data:    nil,
-		})
-		return
+	// Playlist lookups hit the API's database or callback, so they wait for
+	// admission like everything else that costs a backend call
+	if req.PlaylistID != "" {
+		if err := s.resolvePlaylist(ctx, &req); err != nil {
+			s.writeRequestError(w, err)
+			return
+		}
+		if authURL, ok = s.playerAuthURL(w, req); !ok {
+			return
+		}
 	}
+	baseURL, username, password := req.BaseURL, req.Username, req.Password
 
-	authCtx, cancel := context.WithTimeout(ctx, 8*time.Second)
+	authCtx, cancel := context.WithTimeout(ctx, s.current().config.AuthTimeout)
 	defer cancel()
 
 	var whoAmI XtreamWhoAmI
-	if err := s.fetchJSON(authCtx, authURL, &whoAmI); err != nil {
+	authCtx, authSpan := startSpan(authCtx, "xtream.auth", trace.SpanKindInternal, attribute.String("server.address", providerHost(baseURL)))
+	err = s.fetchJSON(authCtx, authURL, &whoAmI)
+	endSpan(authSpan, err)
+	if err != nil {
+		if cancelledByAdmin(ctx) {
+			s.writeCancelled(w)
+			return
+		}
+		if errors.Is(err, errCircuitOpen) {
+			cached, lk := s.cachedFallback(baseURL, username, password)
+			s.writeCircuitOpen(w, err, cached, lk)
+			return
+		}
+		if errors.Is(err, errAddressBlocked) {
+			s.writeAddressBlocked(w, err)
+			return
+		}
 		s.writeJSON(w, http.StatusUnauthorized, ProxyResponse{
 			Success: false,
 			Message: fmt.Sprintf("Authentication failed: %v", err),
@@ -399,15 +711,26 @@ func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Step 2: Fetch all data concurrently with reasonable timeout
-	fetchCtx, cancelFetch := context.WithTimeout(ctx, 30*time.Second) // Balanced timeout
+	fetchCtx, cancelFetch := context.WithTimeout(ctx, s.current().config.FetchTimeout)
 	defer cancelFetch()
 
-	normalized, err := s.fetchAllData(fetchCtx, baseURL, username, password, whoAmI.UserInfo)
+	bypassCache := req.Cache == "bypass"
+	normalized, lookup, err := s.loadCatalog(fetchCtx, baseURL, username, password, whoAmI.UserInfo, bypassCache)
+	if normalized != nil {
+		setCacheHeaders(w, lookup)
+	}
 	if err != nil {
+		if cancelledByAdmin(ctx) {
+			s.writeCancelled(w)
+			return
+		}
+
 		// Even if there's an error, check if we got partial data
 		if normalized != nil {
 			// Return partial data with a warning message
-			s.writeJSON(w, http.StatusPartialContent, ProxyResponse{
+			s.metrics.partialResponses.inc()
+			s.metrics.observeCatalog(normalized)
+			s.writeCatalog(ctx, w, http.StatusPartialContent, ProxyResponse{
 				Success: true,
 				Message: fmt.Sprintf("Partial data retrieved due to some errors: %v", err),
 				Data:    normalized,
@@ -424,33 +747,118 @@ func (s *Server) handleProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.writeJSON(w, http.StatusOK, ProxyResponse{
+	s.metrics.observeCatalog(normalized)
+
+	// Answer since= with only what changed, or fall back to the full catalog
+	var current, base *snapshotIndex
+	message := ""
+	if s.snapshots != nil {
+		key := catalogCacheKey(baseURL, username)
+		current = s.snapshots.record(key, normalized)
+		w.Header().Set("X-Snapshot-ID", current.id)
+
+		if since := req.Since; since != "" {
+			var ok bool
+			if base, ok = s.snapshots.lookup(key, since); !ok {
+				message = fmt.Sprintf("Snapshot %s is no longer available, returning full catalog", since)
+			}
+		}
+	}
+
+	// Let clients skip re-importing an unchanged catalog. A delta gets its
+	// own tag: it is a different body than the full catalog.
+	etag := catalogETag(normalized)
+	if base != nil {
+		etag = deltaETag(base.id, normalized)
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if base != nil {
+		s.writeCatalog(ctx, w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Data:    buildDelta(base, current, normalized),
+		})
+		return
+	}
+	s.writeCatalog(ctx, w, http.StatusOK, ProxyResponse{
 		Success: true,
+		Message: message,
 		Data:    normalized,
 	})
 }
 
-// fetchAllData concurrently fetches all required data
-func (s *Server) fetchAllData(ctx context.Context, baseURL, username, password string, userInfo XtreamUserInfo) (*NormalizedData, error) {
+// catalogSection pairs a category action with the stream action grouped by it
+type catalogSection struct {
+	label         string
+	categoriesKey string
+	streamsKey    string
+}
+
+// catalogSections lists the Xtream actions that make up a full catalog
+var catalogSections = []catalogSection{
+	{label: "live", categoriesKey: "live_categories", streamsKey: "live_streams"},
+	{label: "VOD", categoriesKey: "vod_categories", streamsKey: "vod_streams"},
+	{label: "series", categoriesKey: "series_categories", streamsKey: "series"},
+}
+
+// catalogActions maps each job key to its player_api action
+var catalogActions = map[string]string{
+	"live_categories":   "get_live_categories",
+	"live_streams":      "get_live_streams",
+	"vod_categories":    "get_vod_categories",
+	"vod_streams":       "get_vod_streams",
+	"series_categories": "get_series_categories",
+	"series":            "get_series",
+}
+
+// fetchAllData concurrently fetches all required data.
+// When keys is non-nil only those jobs run, and every section that is not
+// fetched (or fails) is taken from prev. The returned map holds the keys
+// that were fetched successfully.
+func (s *Server) fetchAllData(ctx context.Context, baseURL, username, password string, userInfo XtreamUserInfo, keys map[string]bool, prev *NormalizedData) (*NormalizedData, map[string]bool, error) {
 	var hasErrors bool
+	logger := logFor(ctx).With("host", providerHost(baseURL))
 	type job struct {
 		key    string
 		params map[string]string
+		decode decodeFunc
 	}
 
 	type result struct {
-		key string
-		val any
-		err error
+		key      string
+		attempts []attemptRecord
+		err      error
+		duration time.Duration
 	}
 
-	jobs := []job{
-		{key: "live_categories", params: map[string]string{"action": "get_live_categories"}},
-		{key: "live_streams", params: map[string]string{"action": "get_live_streams"}},
-		{key: "vod_categories", params: map[string]string{"action": "get_vod_categories"}},
-		{key: "vod_streams", params: map[string]string{"action": "get_vod_streams"}},
-		{key: "series_categories", params: map[string]string{"action": "get_series_categories"}},
-		{key: "series", params: map[string]string{"action": "get_series"}},
+	// Each job decodes straight into its own typed destination
+	fetchedCategories := make(map[string]*[]CategoryInfo, len(catalogSections))
+	groupers := make(map[string]*streamGrouper, len(catalogSections))
+
+	var jobs []job
+	for _, sec := range catalogSections {
+		if keys == nil || keys[sec.categoriesKey] {
+			dst := new([]CategoryInfo)
+			fetchedCategories[sec.categoriesKey] = dst
+			jobs = append(jobs, job{
+				key:    sec.categoriesKey,
+				params: map[string]string{"action": catalogActions[sec.categoriesKey]},
+				decode: decodeCategories(dst),
+			})
+		}
+		if keys == nil || keys[sec.streamsKey] {
+			g := newStreamGrouper(strings.ToLower(sec.label))
+			groupers[sec.streamsKey] = g
+			jobs = append(jobs, job{
+				key:    sec.streamsKey,
+				params: map[string]string{"action": catalogActions[sec.streamsKey]},
+				decode: g.decode,
+			})
+		}
 	}
 
 	results := make(chan result, len(jobs))
@@ -467,19 +875,21 @@ func (s *Server) fetchAllData(ctx context.Context, baseURL, username, password s
 				return
 			}
 
-			var payload any
-			if err := s.fetchJSON(ctx, url, &payload); err != nil {
-				results <- result{key: job.key, err: err}
-				return
-			}
-
-			results <- result{key: job.key, val: payload}
+			start := time.Now()
+			jobCtx, jobSpan := startSpan(withLogAttrs(ctx, "job", job.key), "fetch "+job.key, trace.SpanKindInternal, attribute.String("job", job.key), attribute.String("server.address", providerHost(baseURL)))
+			attempts, err := s.fetchDecode(jobCtx, url, job.decode)
+			jobSpan.SetAttributes(attribute.Int("attempts", len(attempts)))
+			endSpan(jobSpan, err)
+			results <- result{key: job.key, attempts: attempts, err: err, duration: time.Since(start)}
 		}(j)
 	}
 
 	wg.Wait()
 	close(results)
 
+	_, normalizeSpan := startSpan(ctx, "normalize", trace.SpanKindInternal)
+	defer normalizeSpan.End()
+
 	// Build normalized response
 	normalized := &NormalizedData{
 		UserInfo:           userInfo,
@@ -488,93 +898,66 @@ func (s *Server) fetchAllData(ctx context.Context, baseURL, username, password s
 		Statistics:         Statistics{},
 		FetchedAt:          time.Now().UnixMilli(),
 	}
+	if prev != nil {
+		normalized.Categories = prev.Categories
+		normalized.CategorizedStreams = prev.CategorizedStreams
+	}
 
-	// Temporary storage for raw data
-	rawData := make(map[string]interface{})
+	// Track which jobs produced usable data
+	succeeded := make(map[string]bool, len(jobs))
 
 	// Process results with enhanced error handling
 	successCount := 0
 	totalJobs := len(jobs)
 	for res := range results {
+		jobLogger := logger.With("job", res.key, "attempts", len(res.attempts), "duration_ms", ms(res.duration))
 		if res.err != nil {
-			log.Printf("Error fetching %s after all retries: %v", res.key, res.err)
+			jobLogger.Warn("Job failed", "error", res.err.Error())
+			for _, a := range res.attempts {
+				jobLogger.Warn("Job attempt", "attempt", a.Attempt, "status", a.Status, "decision", a.Decision, "reason", a.Reason, "error", a.Error)
+			}
 			hasErrors = true
 		} else {
-			rawData[res.key] = res.val
+			succeeded[res.key] = true
 			successCount++
-			log.Printf("Successfully fetched %s", res.key)
+			jobLogger.Info("Job fetched")
 		}
 	}
 
 	// Log summary of fetch results
-	log.Printf("Fetch completed: %d/%d requests succeeded", successCount, totalJobs)
+	logger.Info("Fetch completed", "succeeded", successCount, "jobs", totalJobs)
 
 	// If we have very low success rate, log a warning but continue with partial data
 	if successCount < totalJobs/2 {
-		log.Printf("Warning: Low success rate (%d/%d), returning partial data", successCount, totalJobs)
+		logger.Warn("Low success rate, returning partial data", "succeeded", successCount, "jobs", totalJobs)
 	}
 
-	// Process categories with error handling
-	if val, ok := rawData["live_categories"]; ok && val != nil {
-		if categories := normalizeCategories(val); len(categories) > 0 {
-			normalized.Categories.Live = categories
-			log.Printf("Processed %d live categories", len(categories))
-		} else {
-			log.Println("Warning: No valid live categories found")
-		}
-	}
-	if val, ok := rawData["vod_categories"]; ok && val != nil {
-		if categories := normalizeCategories(val); len(categories) > 0 {
-			normalized.Categories.VOD = categories
-			log.Printf("Processed %d VOD categories", len(categories))
-		} else {
-			log.Println("Warning: No valid VOD categories found")
-		}
-	}
-	if val, ok := rawData["series_categories"]; ok && val != nil {
-		if categories := normalizeCategories(val); len(categories) > 0 {
-			normalized.Categories.Series = categories
-			log.Printf("Processed %d series categories", len(categories))
-		} else {
-			log.Println("Warning: No valid series categories found")
-		}
-	}
+	// Process categories, then group streams by category for efficient frontend display
+	for _, sec := range catalogSections {
+		categories, categorizedStreams := normalized.sectionFields(sec)
 
-	// Process streams and group by category for efficient frontend display
-	if val, ok := rawData["live_streams"]; ok && val != nil {
-		if categorizedStreams := categorizeStreams(val, normalized.Categories.Live, "live"); len(categorizedStreams) > 0 {
-			normalized.CategorizedStreams.Live = categorizedStreams
-			totalLive := 0
-			for _, cat := range categorizedStreams {
-				totalLive += cat.StreamCount
-			}
-			log.Printf("Processed %d live streams across %d categories", totalLive, len(categorizedStreams))
-		} else {
-			log.Println("Warning: No valid live streams found")
-		}
-	}
-	if val, ok := rawData["vod_streams"]; ok && val != nil {
-		if categorizedStreams := categorizeStreams(val, normalized.Categories.VOD, "vod"); len(categorizedStreams) > 0 {
-			normalized.CategorizedStreams.VOD = categorizedStreams
-			totalVod := 0
-			for _, cat := range categorizedStreams {
-				totalVod += cat.StreamCount
+		if succeeded[sec.categoriesKey] {
+			if fetched := *fetchedCategories[sec.categoriesKey]; len(fetched) > 0 {
+				*categories = fetched
+				logger.Debug("Processed categories", "section", sec.label, "categories", len(fetched))
+			} else {
+				*categories = []CategoryInfo{}
+				logger.Warn("No valid categories found", "section", sec.label)
 			}
-			log.Printf("Processed %d VOD streams across %d categories", totalVod, len(categorizedStreams))
-		} else {
-			log.Println("Warning: No valid VOD streams found")
 		}
-	}
-	if val, ok := rawData["series"]; ok && val != nil {
-		if categorizedStreams := categorizeStreams(val, normalized.Categories.Series, "series"); len(categorizedStreams) > 0 {
-			normalized.CategorizedStreams.Series = categorizedStreams
-			totalSeries := 0
-			for _, cat := range categorizedStreams {
-				totalSeries += cat.StreamCount
+
+		if succeeded[sec.streamsKey] {
+			if grouped := groupers[sec.streamsKey].build(*categories); len(grouped) > 0 {
+				*categorizedStreams = grouped
+				total := 0
+				for _, cat := range grouped {
+					total += cat.StreamCount
+				}
+				logger.Debug("Processed streams", "section", sec.label, "streams", total, "categories", len(grouped))
+			} else {
+				*categorizedStreams = []CategoryWithStreams{}
+				logger.Warn("No valid streams found", "section", sec.label)
 			}
-			log.Printf("Processed %d series streams across %d categories", totalSeries, len(categorizedStreams))
-		} else {
-			log.Println("Warning: No valid series streams found")
 		}
 	}
 
@@ -598,180 +981,35 @@ func (s *Server) fetchAllData(ctx context.Context, baseURL, username, password s
 	}
 
 	// Log processing summary
-	log.Printf("Data processing complete - Live: %d, VOD: %d, Series: %d, Total: %d",
-		normalized.Statistics.TotalLive,
-		normalized.Statistics.TotalVOD,
-		normalized.Statistics.TotalSeries,
-		normalized.Statistics.TotalItems)
-
-	log.Printf("Categories - Live: %d, VOD: %d, Series: %d",
-		len(normalized.Categories.Live),
-		len(normalized.Categories.VOD),
-		len(normalized.Categories.Series))
+	logger.Info("Data processing complete",
+		"live", normalized.Statistics.TotalLive,
+		"vod", normalized.Statistics.TotalVOD,
+		"series", normalized.Statistics.TotalSeries,
+		"total", normalized.Statistics.TotalItems,
+		"live_categories", len(normalized.Categories.Live),
+		"vod_categories", len(normalized.Categories.VOD),
+		"series_categories", len(normalized.Categories.Series))
+
+	normalized.digest = catalogDigest(normalized)
+	normalized.SnapshotID = hex.EncodeToString(normalized.digest[:16])
 
 	// Always return the normalized data, even if it's partial
 	// The caller will decide whether to return it as partial data or error
 	if hasErrors {
-		return normalized, fmt.Errorf("partial data: %d/%d requests succeeded", successCount, totalJobs)
-	}
-	return normalized, nil
-}
-
-// normalizeCategories converts raw category data to structured CategoryInfo
-func normalizeCategories(val interface{}) []CategoryInfo {
-	if val == nil {
-		return []CategoryInfo{}
-	}
-
-	slice := ensureSlice(val)
-	categories := make([]CategoryInfo, 0, len(slice))
-
-	for _, item := range slice {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			category := CategoryInfo{
-				CategoryID:   getStringValue(itemMap, "category_id"),
-				CategoryName: getStringValue(itemMap, "category_name"),
-			}
-
-			// Only add if we have essential fields
-			if category.CategoryID != "" && category.CategoryName != "" {
-				categories = append(categories, category)
-			}
-		}
-	}
-
-	return categories
-}
-
-// categorizeStreams converts raw stream data and groups by category for efficient frontend display
-func categorizeStreams(val interface{}, categories []CategoryInfo, streamType string) []CategoryWithStreams {
-	if val == nil {
-		return []CategoryWithStreams{}
-	}
-
-	slice := ensureSlice(val)
-
-	// Create category ID to name mapping and initialize category groups
-	categoryMap := make(map[string]string)
-	categoryGroups := make(map[string][]StreamInfo)
-
-	for _, cat := range categories {
-		categoryMap[cat.CategoryID] = cat.CategoryName
-		categoryGroups[cat.CategoryID] = []StreamInfo{}
-	}
-
-	// Add "Uncategorized" category for streams without valid category
-	categoryGroups["uncategorized"] = []StreamInfo{}
-
-	// Process each stream and group by category
-	for _, item := range slice {
-		if itemMap, ok := item.(map[string]interface{}); ok {
-			stream := StreamInfo{
-				Num:        getInterfaceValue(itemMap, "num"),
-				Name:       getStringValue(itemMap, "name"),
-				CategoryID: getStringValue(itemMap, "category_id"),
-				StreamIcon: getStringValue(itemMap, "stream_icon"),
-				StreamType: getStringValue(itemMap, "stream_type"),
-				StreamID:   getInterfaceValue(itemMap, "stream_id"),
-				SeriesID:   getInterfaceValue(itemMap, "series_id"),
-				Added:      getStringValue(itemMap, "added"),
-				Rating:     getStringValue(itemMap, "rating"),
-			}
-
-			// Add VOD/Series specific fields that actually exist
-			if streamType == "vod" || streamType == "series" {
-				stream.Cover = getStringValue(itemMap, "cover")
-				stream.Plot = getStringValue(itemMap, "plot")
-				stream.Cast = getStringValue(itemMap, "cast")
-				stream.Director = getStringValue(itemMap, "director")
-				stream.Genre = getStringValue(itemMap, "genre")
-				stream.ReleaseDate = getStringValue(itemMap, "releaseDate")
-			}
-
-			// Only process if we have essential fields
-			if stream.Name == "" {
-				continue
-			}
-
-			// Determine category and set category name
-			categoryId := stream.CategoryID
-			if categoryName, exists := categoryMap[categoryId]; exists {
-				stream.CategoryName = categoryName
-				categoryGroups[categoryId] = append(categoryGroups[categoryId], stream)
-			} else {
-				stream.CategoryName = "Uncategorized"
-				categoryGroups["uncategorized"] = append(categoryGroups["uncategorized"], stream)
-			}
-		}
-	}
-
-	// Build the final categorized structure
-	var result []CategoryWithStreams
-
-	// Add categories that have streams
-	for _, cat := range categories {
-		streams := categoryGroups[cat.CategoryID]
-		if len(streams) > 0 {
-			result = append(result, CategoryWithStreams{
-				CategoryID:   cat.CategoryID,
-				CategoryName: cat.CategoryName,
-				Streams:      streams,
-				StreamCount:  len(streams),
-			})
-		}
-	}
-
-	// Add uncategorized streams if any
-	uncategorizedStreams := categoryGroups["uncategorized"]
-	if len(uncategorizedStreams) > 0 {
-		result = append(result, CategoryWithStreams{
-			CategoryID:   "uncategorized",
-			CategoryName: "Uncategorized",
-			Streams:      uncategorizedStreams,
-			StreamCount:  len(uncategorizedStreams),
-		})
+		return normalized, succeeded, fmt.Errorf("partial data: %d/%d requests succeeded", successCount, totalJobs)
 	}
-
-	return result
-}
-
-// Helper functions for safe data extraction
-func getStringValue(m map[string]interface{}, keys ...string) string {
-	for _, key := range keys {
-		if val, ok := m[key]; ok && val != nil {
-			if str, ok := val.(string); ok {
-				return str
-			}
-			// Convert number to string if needed
-			if num, ok := val.(float64); ok {
-				return fmt.Sprintf("%.0f", num)
-			}
-		}
-	}
-	return ""
+	return normalized, succeeded, nil
 }
 
-func getInterfaceValue(m map[string]interface{}, keys ...string) interface{} {
-	for _, key := range keys {
-		if val, ok := m[key]; ok {
-			return val
-		}
-	}
-	return nil
-}
-
-// ensureSlice converts any value to a slice, handling nil and non-slice values
-func ensureSlice(val any) []any {
-	if val == nil {
-		return []any{}
-	}
-
-	switch v := val.(type) {
-	case []any:
-		return v
+// sectionFields returns pointers to the category and stream lists of a section
+func (n *NormalizedData) sectionFields(sec catalogSection) (*[]CategoryInfo, *[]CategoryWithStreams) {
+	switch sec.categoriesKey {
+	case "live_categories":
+		return &n.Categories.Live, &n.CategorizedStreams.Live
+	case "vod_categories":
+		return &n.Categories.VOD, &n.CategorizedStreams.VOD
 	default:
-		// If it's not a slice, wrap it in one
-		return []any{v}
+		return &n.Categories.Series, &n.CategorizedStreams.Series
 	}
 }
 
@@ -811,84 +1049,191 @@ func (s *Server) buildPlayerURL(baseURL, username, password string, params map[s
 	return u.String(), nil
 }
 
-// fetchJSON makes HTTP request and decodes JSON response with simple retry logic
-func (s *Server) fetchJSON(ctx context.Context, url string, target any) (err error) {
+// providerHost returns the lower-cased host of a provider base URL
+func providerHost(baseURL string) string {
+	if !strings.HasPrefix(baseURL, "http://") && !strings.HasPrefix(baseURL, "https://") {
+		baseURL = "http://" + baseURL
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return strings.ToLower(baseURL)
+	}
+	return strings.ToLower(u.Host)
+}
+
+// fetchJSON makes HTTP request and decodes JSON response with retries
+func (s *Server) fetchJSON(ctx context.Context, url string, target any) error {
+	_, err := s.fetchDecode(ctx, url, func(r io.Reader) error {
+		decoder := json.NewDecoder(r)
+		decoder.UseNumber() // Preserve number precision
+		return decoder.Decode(target)
+	})
+	return err
+}
+
+// fetchDecode makes HTTP request, retrying as s.retry decides, and hands the
+// successful response body to decode. Every attempt and the decision taken
+// after it are returned alongside the error.
+func (s *Server) fetchDecode(ctx context.Context, url string, decode decodeFunc) (attempts []attemptRecord, err error) {
+	// Shown on /admin/requests; runs after the recover below has set err
+	var job *inflightJob
+	defer func() { job.finish(err) }()
+
 	// Top-level recover to prevent server crash from any panic in this function
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("PANIC RECOVERED in fetchJSON for URL %s: %v", url, r)
+			logFor(ctx).Error("Panic recovered in fetchDecode", "url", redact(url), "panic", fmt.Sprint(r))
 			err = fmt.Errorf("unexpected internal error: %v", r)
 		}
 	}()
 
-	var lastErr error
-	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
-		if attempt > 0 {
-			// Simple linear backoff delay
-			delay := time.Duration(attempt) * s.config.RetryDelay
-			log.Printf("Retrying request to %s after %v (attempt %d/%d)", url, delay, attempt, s.config.MaxRetries)
-
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case <-time.After(delay):
-				// Continue with retry
-			}
-		}
-
+	for attempt := 0; ; attempt++ {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if err != nil {
-			return fmt.Errorf("failed to create request: %w", err)
+			return attempts, fmt.Errorf("failed to create request: %w", err)
 		}
 
 		req.Header.Set("Accept", "application/json")
 		req.Header.Set("User-Agent", "SyncStream-Proxy/1.0")
 
-		resp, err := s.client.Do(req)
+		action := req.URL.Query().Get("action")
+		if action == "" {
+			action = "auth"
+		}
+		host := strings.ToLower(req.URL.Host)
+		if job == nil {
+			job = inflightFrom(ctx).startJob(action, host)
+		}
+		job.setAttempt(attempt)
+
+		record := attemptRecord{Attempt: attempt}
+		circuitOpen := func(err error) ([]attemptRecord, error) {
+			// Fail fast instead of waiting out retries against a dead provider
+			record.Error = err.Error()
+			record.Decision = "give_up"
+			record.Reason = "circuit open"
+			return append(attempts, record), err
+		}
+		if err := s.breakers.check(req.URL.Host); err != nil {
+			return circuitOpen(err)
+		}
+
+		logger := logFor(ctx).With("host", host, "action", action)
+		_, attemptSpan := startSpan(ctx, "GET "+action, trace.SpanKindClient, attribute.String("server.address", host), attribute.String("xtream.action", action), attribute.Int("attempt", attempt))
+		started := time.Now()
+
+		// The breaker is asked once the limiter slot is held, so a half-open
+		// probe is not spent queueing, and a wait in the proxy's own queue
+		// that runs out says nothing about the host
+		var resp *http.Response
+		outcome := outcomeIgnored
+		release, err := s.upstream.acquire(ctx, req.URL.Host, req.URL.Query().Get("username"))
 		if err != nil {
-			// Simple retry for network errors
-			lastErr = fmt.Errorf("request failed: %w", err)
-			if attempt == s.config.MaxRetries {
-				return lastErr
+			err = fmt.Errorf("waiting for an upstream slot: %w", err)
+		} else {
+			done, allowErr := s.breakers.allow(req.URL.Host)
+			if allowErr != nil {
+				release()
+				endSpan(attemptSpan, allowErr)
+				return circuitOpen(allowErr)
 			}
-			continue
+			resp, err = s.send(req, release)
+			outcome = attemptOutcome(resp, err)
+			done(outcome)
 		}
 
-		// Check if we should retry on 404 (rate limit indicator)
-		if resp.StatusCode == http.StatusNotFound {
+		var attemptErr error
+		switch {
+		case err != nil:
+			attemptErr = fmt.Errorf("request failed: %w", redactError(err))
+		case resp.StatusCode == http.StatusNotFound:
+			// Xtream panels answer 404 when rate limiting
+			attemptErr = fmt.Errorf("rate limited (404): %s", resp.Status)
+			s.metrics.upstreamLimited.inc(s.metrics.hosts.label(host, true))
+		case resp.StatusCode != http.StatusOK:
+			attemptErr = fmt.Errorf("upstream error: %s", resp.Status)
+		default:
+			// Success - decode the response. A body that fails half way is
+			// not retried because decoders may already hold partial data.
+			record.Status = resp.StatusCode
+			err := decode(resp.Body)
 			resp.Body.Close()
-			lastErr = fmt.Errorf("rate limited (404): %s", resp.Status)
-			if attempt == s.config.MaxRetries {
-				return lastErr
+			s.metrics.upstreamDuration.observe(time.Since(started).Seconds(), action, s.metrics.hosts.label(host, true))
+			s.hostStats.record(host, outcome, time.Since(started), err)
+			logger.Debug("Upstream attempt", "attempt", attempt, "status", record.Status, "duration_ms", ms(time.Since(started)))
+			attemptSpan.SetAttributes(attribute.Int("http.response.status_code", record.Status))
+			endSpan(attemptSpan, err)
+			if err != nil {
+				record.Error = err.Error()
+				record.Decision = "give_up"
+				record.Reason = "invalid response body"
+				return append(attempts, record), fmt.Errorf("failed to decode JSON: %w", err)
 			}
-			continue
-		}
 
-		// For other non-200 status codes, don't retry
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return fmt.Errorf("upstream error: %s", resp.Status)
+			record.Decision = "success"
+			if attempt > 0 {
+				logger.Info("Upstream request succeeded after retries", "retries", attempt)
+			}
+			return append(attempts, record), nil
 		}
 
-		// Success - decode the response
-		decoder := json.NewDecoder(resp.Body)
-		decoder.UseNumber() // Preserve number precision
-
-		if err := decoder.Decode(target); err != nil {
+		decision := s.current().retry.Decide(ctx, attempt, resp, err)
+		if resp != nil {
+			record.Status = resp.StatusCode
 			resp.Body.Close()
-			return fmt.Errorf("failed to decode JSON: %w", err)
 		}
+		s.metrics.upstreamDuration.observe(time.Since(started).Seconds(), action, s.metrics.hosts.label(host, resp != nil))
+		s.hostStats.record(host, outcome, time.Since(started), attemptErr)
+		logger.Debug("Upstream attempt", "attempt", attempt, "status", record.Status, "duration_ms", ms(time.Since(started)), "error", attemptErr.Error())
+		if record.Status != 0 {
+			attemptSpan.SetAttributes(attribute.Int("http.response.status_code", record.Status))
+		}
+		attemptSpan.SetAttributes(attribute.Bool("retry", decision.Retry))
+		endSpan(attemptSpan, attemptErr)
+		record.Error = attemptErr.Error()
+		s.breakers.noteError(req.URL.Host, record.Error)
+		record.Reason = decision.Reason
+		record.Delay = decision.Delay
+		record.Decision = "give_up"
+		if decision.Retry {
+			record.Decision = "retry"
+			s.metrics.upstreamRetries.inc(action, retryCause(ctx, resp, err))
+		}
+		attempts = append(attempts, record)
 
-		resp.Body.Close()
+		if !decision.Retry {
+			return attempts, attemptErr
+		}
 
-		if attempt > 0 {
-			log.Printf("Request to %s succeeded after %d retries", url, attempt)
+		logger.Warn("Retrying upstream request", "attempt", attempt+1, "delay_ms", ms(decision.Delay), "reason", decision.Reason, "error", attemptErr.Error())
+		select {
+		case <-ctx.Done():
+			return attempts, ctx.Err()
+		case <-time.After(decision.Delay):
+			// Continue with retry
 		}
+	}
+}
 
-		return nil
+// retryCause labels a retried attempt by upstream status or error class
+func retryCause(ctx context.Context, resp *http.Response, err error) string {
+	if resp != nil {
+		return strconv.Itoa(resp.StatusCode)
 	}
+	_, reason := classifyError(ctx, err)
+	return reason
+}
 
-	return lastErr
+// send makes req while holding the per-host limiter slot release gives
+// back. The slot is held until the response body is closed.
+func (s *Server) send(req *http.Request, release func()) (*http.Response, error) {
+	resp, err := s.current().client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
 }
 
 // writeJSON writes JSON response with proper headers
@@ -900,26 +1245,95 @@ func (s *Server) writeJSON(w http.ResponseWriter, statusCode int, data any) {
 	encoder.SetEscapeHTML(false) // Don't escape HTML in JSON strings
 
 	if err := encoder.Encode(data); err != nil {
-		log.Printf("Failed to encode JSON response: %v", err)
+		slog.Error("Failed to encode JSON response", "error", err.Error())
 	}
 }
 
+// writeCatalog writes a catalog response under an encode span; large
+// catalogs spend real time here
+func (s *Server) writeCatalog(ctx context.Context, w http.ResponseWriter, statusCode int, resp ProxyResponse) {
+	_, sp := startSpan(ctx, "encode", trace.SpanKindInternal)
+	s.writeJSON(w, statusCode, resp)
+	sp.End()
+}
+
+// Process exit codes
+const (
+	exitServeError   = 1   // the listener failed
+	exitConfigError  = 2   // the configuration is invalid
+	exitDrainTimeout = 3   // in-flight requests were cancelled at the shutdown timeout
+	exitInterrupted  = 130 // a second signal cut the drain short
+)
+
 func main() {
-	config := DefaultConfig()
-	server := NewServer(config)
+	config, printOnly, err := LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, redact(err.Error()))
+		os.Exit(exitConfigError)
+	}
+	if printOnly {
+		if err := printConfig(os.Stdout, config); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitConfigError)
+		}
+		return
+	}
 
-	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
-	defer cancel()
+	// Every log line, including the standard logger's, is structured and
+	// passes through the credential filter
+	level, _ := parseLogLevel(config.LogLevel)
+	logLevel.Set(level)
+	slog.SetDefault(newLogger(os.Stderr, config.LogFormat))
 
-	// Start server
-	if err := server.Start(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("Server failed to start: %v", err)
+	server, err := NewServer(config)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err.Error())
+		os.Exit(exitConfigError)
+	}
+	server.loadConfig = func() (*Config, error) {
+		config, _, err := LoadConfig(os.Args[1:], os.Getenv)
+		return config, err
 	}
 
-	// Wait for shutdown signal
-	<-ctx.Done()
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server shutdown error: %v", err)
+	// SIGHUP re-reads the config file and environment
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			server.reloadConfig()
+		}
+	}()
+
+	// SIGINT and SIGTERM start a drain; a second one exits at once
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Start() }()
+
+	select {
+	case err := <-serveErr:
+		slog.Error("Server failed", "error", err.Error())
+		os.Exit(exitServeError)
+	case sig := <-stop:
+		slog.Info("Draining in-flight requests", "signal", sig.String())
+	}
+	go func() {
+		sig := <-stop
+		slog.Warn("Exiting without draining", "signal", sig.String())
+		os.Exit(exitInterrupted)
+	}()
+
+	config = server.current().config
+	ctx, cancel := context.WithTimeout(context.Background(), config.DrainDelay+config.ShutdownTimeout)
+	err = server.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		slog.Error("Server shutdown incomplete", "error", err.Error())
+		os.Exit(exitDrainTimeout)
 	}
+	slog.Info("Server stopped")
 }
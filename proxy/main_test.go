@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+)
+
+// TestMain runs the proxy itself instead of the tests when a test re-execs
+// this binary with PROXY_TEST_MAIN set, see startProxy
+func TestMain(m *testing.M) {
+	if os.Getenv("PROXY_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestServer builds a server on the default configuration, changed by
+// configure, and stops its background work when the test ends
+func newTestServer(t testing.TB, configure func(*Config)) *Server {
+	t.Helper()
+	config := DefaultConfig()
+	if configure != nil {
+		configure(config)
+	}
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(s.cancelWork)
+	return s
+}
+
+// serve runs one request through the server's full handler chain
+func serve(s *Server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(w, r)
+	return w
+}
+
+// signHS256 builds a JWT over header and claims with key
+func signHS256(t *testing.T, key string, header, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+	signed := segment(header) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newUpstream serves handler and lets the test server reach it
+func newUpstream(t testing.TB, handler http.HandlerFunc) (*httptest.Server, func(*Config)) {
+	t.Helper()
+	upstream := httptest.NewServer(handler)
+	t.Cleanup(upstream.Close)
+	return upstream, func(c *Config) { c.Egress.Allowed = []string{"127.0.0.1/32"} }
+}
+
+// panel is a fake Xtream panel serving a catalog the test can change
+type panel struct {
+	URL string
+
+	mu        sync.Mutex
+	responses map[string]string // player_api action to body, "" is the login
+	hits      map[string]int
+	gates     map[string]*panelGate
+}
+
+type panelGate struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+// newPanel serves an active account with an empty catalog
+func newPanel(t testing.TB) (*panel, func(*Config)) {
+	t.Helper()
+	p := &panel{
+		responses: map[string]string{"": `{"user_info":{"auth":1,"status":"Active"}}`},
+		hits:      make(map[string]int),
+		gates:     make(map[string]*panelGate),
+	}
+	upstream, allow := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		action := r.URL.Query().Get("action")
+		p.mu.Lock()
+		body, ok := p.responses[action]
+		p.hits[action]++
+		gate := p.gates[action]
+		p.mu.Unlock()
+		if gate != nil {
+			gate.entered <- struct{}{}
+			select {
+			case <-gate.release:
+			case <-r.Context().Done():
+			}
+		}
+		if !ok {
+			body = `[]`
+		}
+		io.WriteString(w, body)
+	})
+	p.URL = upstream.URL
+	return p, allow
+}
+
+// set changes what the panel answers for action
+func (p *panel) set(action, body string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.responses[action] = body
+}
+
+// hold makes requests for action wait until release is called. Each
+// request signals on entered once it arrived.
+func (p *panel) hold(action string) (entered <-chan struct{}, release func()) {
+	gate := &panelGate{entered: make(chan struct{}, 16), release: make(chan struct{})}
+	p.mu.Lock()
+	p.gates[action] = gate
+	p.mu.Unlock()
+	return gate.entered, sync.OnceFunc(func() { close(gate.release) })
+}
+
+// requests returns how often action was fetched
+func (p *panel) requests(action string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.hits[action]
+}
+
+// catalogRequest asks for baseURL's catalog with credentials in headers
+func catalogRequest(baseURL, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/get?"+query, nil)
+	r.Header.Set(headerBaseURL, baseURL)
+	r.Header.Set(headerUsername, "alice")
+	r.Header.Set(headerPassword, "secret")
+	return r
+}
+
+// discard is a decodeFunc that reads and drops the body
+func discard(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func mustHost(t *testing.T, raw string) string {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus exposition without depending on the Prometheus client library.
+// Only what the proxy needs: counters and histograms with labels, and gauges
+// read at scrape time.
+
+// latencyBuckets are the histogram bounds of request and upstream latency, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// catalogBuckets are the histogram bounds of items per catalog section
+var catalogBuckets = []float64{100, 1000, 5000, 10000, 50000, 100000, 250000, 500000, 1000000}
+
+// metricFamily is one metric name with a fixed set of label names
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string // "counter" or "histogram"
+	labels  []string
+	buckets []float64 // histograms only
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // keyed by joined label values
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // counters
+	counts      []uint64 // histograms, per bucket (not cumulative)
+	sum         float64
+	count       uint64
+}
+
+func newCounter(name, help string, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: "counter", labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metricFamily {
+	return &metricFamily{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets, series: make(map[string]*metricSeries)}
+}
+
+// get returns the series for labelValues. Callers must hold f.mu.
+func (f *metricFamily) get(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: slices.Clone(labelValues)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// inc adds one to a counter
+func (f *metricFamily) inc(labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(labelValues).value++
+}
+
+// observe records v in a histogram
+func (f *metricFamily) observe(v float64, labelValues ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := f.get(labelValues)
+	if i := sort.SearchFloat64s(f.buckets, v); i < len(f.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+// total sums a counter over the series whose labels match, for derived gauges
+func (f *metricFamily) total(match func(labelValues []string) bool) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var total float64
+	for _, s := range f.series {
+		if match(s.labelValues) {
+			total += s.value
+		}
+	}
+	return total
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := formatLabels(f.labels, s.labelValues)
+		if f.kind == "counter" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labels, formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += s.counts[i]
+			le := formatLabels(append(slices.Clone(f.labels), "le"), append(slices.Clone(s.labelValues), formatFloat(bound)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le, cumulative)
+		}
+		le := formatLabels(append(slices.Clone(f.labels), "le"), append(slices.Clone(s.labelValues), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, le, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labels, s.count)
+	}
+}
+
+// scrapeMetric is an unlabelled gauge or counter read when scraped, for
+// values the server already keeps elsewhere
+type scrapeMetric struct {
+	name  string
+	help  string
+	kind  string // "gauge" or "counter"
+	value func() float64
+}
+
+func (m scrapeMetric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatFloat(m.value()))
+}
+
+// writeGauges writes a gauge family read at scrape time, one series per
+// value of label
+func writeGauges(w io.Writer, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels([]string{label}, []string{key}), formatFloat(values[key]))
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// proxyMetrics holds everything /metrics exposes besides scrape-time values
+type proxyMetrics struct {
+	requests         *metricFamily
+	requestDuration  *metricFamily
+	upstreamDuration *metricFamily
+	upstreamRetries  *metricFamily
+	upstreamLimited  *metricFamily
+	partialResponses *metricFamily
+	catalogItems     *metricFamily
+	cacheLookups     *metricFamily
+	queueWait        *metricFamily
+	queueRejected    *metricFamily
+
+	hosts hostLabels
+}
+
+// otherHost labels provider hosts beyond the first maxTrackedHosts, and
+// attempts against unknown hosts that got no answer
+const otherHost = "other"
+
+// hostLabels bounds the provider hosts used as label values, which come
+// from user-supplied base_urls. A host gets its own series once it has
+// answered, until maxTrackedHosts hosts have; anything else is folded into
+// otherHost, so unresolvable names cannot grow the label set either.
+type hostLabels struct {
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+// label returns the label value for host; answered says whether this
+// attempt got an HTTP response
+func (h *hostLabels) label(host string, answered bool) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.known[host] {
+		return host
+	}
+	if !answered || len(h.known) >= maxTrackedHosts {
+		return otherHost
+	}
+	if h.known == nil {
+		h.known = make(map[string]bool)
+	}
+	h.known[host] = true
+	return host
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{
+		requests:         newCounter("proxy_http_requests_total", "HTTP requests served, by route and status.", "route", "status"),
+		requestDuration:  newHistogram("proxy_http_request_duration_seconds", "HTTP request latency, by route and status.", latencyBuckets, "route", "status"),
+		upstreamDuration: newHistogram("proxy_upstream_request_duration_seconds", "Latency of one upstream attempt including the body, by action and provider host (\"other\" past the tracked hosts).", latencyBuckets, "action", "host"),
+		upstreamRetries:  newCounter("proxy_upstream_retries_total", "Upstream attempts that were retried, by action and cause (status code or error class).", "action", "cause"),
+		upstreamLimited:  newCounter("proxy_upstream_rate_limited_total", "Upstream 404 responses, which Xtream panels use for rate limiting, by provider host (\"other\" past the tracked hosts).", "host"),
+		partialResponses: newCounter("proxy_partial_responses_total", "/get responses served as 206 with part of the catalog."),
+		catalogItems:     newHistogram("proxy_catalog_items", "Items per catalog section in /get responses.", catalogBuckets, "section"),
+		cacheLookups:     newCounter("proxy_catalog_cache_lookups_total", "Catalog cache lookups, by result (HIT, STALE, EXPIRED, MISS, BYPASS).", "status"),
+		queueWait:        newHistogram("proxy_queue_wait_seconds", "Time /get and /test requests spent waiting for a concurrency slot, when they had to.", latencyBuckets),
+		queueRejected:    newCounter("proxy_queue_rejected_total", "Requests that did not get a concurrency slot, by reason (full, timeout, client_gone).", "reason"),
+	}
+}
+
+// observeCatalog records the section sizes of a served catalog
+func (m *proxyMetrics) observeCatalog(data *NormalizedData) {
+	m.catalogItems.observe(float64(data.Statistics.TotalLive), "live")
+	m.catalogItems.observe(float64(data.Statistics.TotalVOD), "vod")
+	m.catalogItems.observe(float64(data.Statistics.TotalSeries), "series")
+}
+
+// handleMetrics serves the Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	m := s.metrics
+	for _, f := range []*metricFamily{m.requests, m.requestDuration, m.upstreamDuration, m.upstreamRetries,
+		m.upstreamLimited, m.partialResponses, m.catalogItems, m.cacheLookups, m.queueWait, m.queueRejected} {
+		f.write(bw)
+	}
+
+	scraped := []scrapeMetric{
+		{"proxy_semaphore_in_use", "/get and /test requests holding a concurrency slot.", "gauge", func() float64 { inUse, _, _ := s.admission.stats(); return float64(inUse) }},
+		{"proxy_semaphore_capacity", "Concurrency slots for /get and /test.", "gauge", func() float64 { _, capacity, _ := s.admission.stats(); return float64(capacity) }},
+		{"proxy_semaphore_queued", "/get and /test requests waiting for a concurrency slot.", "gauge", func() float64 { _, _, queued := s.admission.stats(); return float64(queued) }},
+		{"proxy_coalesced_requests_total", "/get requests that joined an identical in-flight fetch.", "counter", func() float64 { return float64(s.stats.coalescedRequests.Load()) }},
+		{"proxy_catalog_cache_hit_ratio", "Share of catalog cache lookups answered without a foreground fetch (HIT or STALE) since start.", "gauge", s.cacheHitRatio},
+	}
+	if s.cache != nil {
+		scraped = append(scraped, scrapeMetric{"proxy_catalog_cache_entries", "Catalogs in the cache.", "gauge", func() float64 { return float64(s.cache.len()) }})
+	}
+	for _, m := range scraped {
+		m.write(bw)
+	}
+
+	inUse, size, queued := make(map[string]float64), make(map[string]float64), make(map[string]float64)
+	for pool, st := range s.admission.poolStats() {
+		inUse[pool], size[pool], queued[pool] = float64(st.InUse), float64(st.Size), float64(st.Queued)
+	}
+	writeGauges(bw, "proxy_pool_in_use", "Requests holding a slot, by route pool.", "pool", inUse)
+	writeGauges(bw, "proxy_pool_size", "Concurrent requests a route pool may run.", "pool", size)
+	writeGauges(bw, "proxy_pool_queued", "Requests waiting for a slot, by route pool.", "pool", queued)
+}
+
+func (s *Server) cacheHitRatio() float64 {
+	lookups := s.metrics.cacheLookups.total(func([]string) bool { return true })
+	if lookups == 0 {
+		return 0
+	}
+	hits := s.metrics.cacheLookups.total(func(v []string) bool {
+		return v[0] == string(cacheHit) || v[0] == string(cacheStale)
+	})
+	return hits / lookups
+}
+
+// metricsMiddleware counts and times requests by the mux pattern they
+// matched, so unknown paths cannot blow up the label set
+func (s *Server) metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(wrapped, r)
+
+		route := "other"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		status := strconv.Itoa(wrapped.statusCode)
+		s.metrics.requests.inc(route, status)
+		s.metrics.requestDuration.observe(time.Since(start).Seconds(), route, status)
+	})
+}
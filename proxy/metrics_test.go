@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostLabelsBounded(t *testing.T) {
+	var h hostLabels
+	if got := h.label("unresolvable.example", false); got != otherHost {
+		t.Errorf("host that never answered = %q, want %q", got, otherHost)
+	}
+	for i := 0; i < maxTrackedHosts; i++ {
+		host := fmt.Sprintf("provider%d.example", i)
+		if got := h.label(host, true); got != host {
+			t.Fatalf("host %d = %q, want its own label", i, got)
+		}
+	}
+	if got := h.label("one-too-many.example", true); got != otherHost {
+		t.Errorf("host past the cap = %q, want %q", got, otherHost)
+	}
+	// Known hosts keep their series, even for attempts that got no answer
+	if got := h.label("provider0.example", false); got != "provider0.example" {
+		t.Errorf("known host without an answer = %q, want its own label", got)
+	}
+}
+
+func TestFailedAttemptsUseOtherHost(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	s := newTestServer(t, func(c *Config) {
+		c.Egress.Allowed = []string{"127.0.0.1/32"}
+		c.MaxRetries = 0
+		c.MetricsAddr = "127.0.0.1:0"
+	})
+	s.fetchDecode(context.Background(), "http://"+closed+"/player_api.php?action=get_live_streams", discard)
+
+	body := scrape(s).Body.String()
+	if strings.Contains(body, closed) {
+		t.Errorf("metrics carry a host that never answered:\n%s", body)
+	}
+	if !strings.Contains(body, `proxy_upstream_request_duration_seconds_count{action="get_live_streams",host="other"} 1`) {
+		t.Errorf("failed attempt not counted under host=\"other\":\n%s", body)
+	}
+}
+
+// scrape fetches /metrics from the metrics listener's handler
+func scrape(s *Server) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.metricsServer.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return w
+}
+
+func TestMetricsAccess(t *testing.T) {
+	// Without auth the main listener keeps /metrics closed, like /admin/*
+	s := newTestServer(t, nil)
+	if w := serve(s, httptest.NewRequest(http.MethodGet, "/metrics", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("/metrics without auth = %d, want 404", w.Code)
+	}
+	if s.metricsServer != nil {
+		t.Error("metrics listener without server.metrics_addr")
+	}
+
+	s = newTestServer(t, func(c *Config) {
+		c.Auth.Secret = "sek"
+		c.MetricsAddr = "127.0.0.1:0"
+	})
+	exp := time.Now().Add(time.Hour).Unix()
+	for token, want := range map[string]int{
+		"": http.StatusUnauthorized,
+		signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": "1", "role": "user", "exp": exp}):  http.StatusForbidden,
+		signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": "1", "role": "admin", "exp": exp}): http.StatusOK,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if w := serve(s, r); w.Code != want {
+			t.Errorf("/metrics on the main listener = %d, want %d", w.Code, want)
+		}
+	}
+
+	// The metrics listener needs no token and serves nothing else
+	if w := scrape(s); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "proxy_semaphore_capacity") {
+		t.Errorf("metrics listener /metrics = %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	s.metricsServer.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("metrics listener /admin/cache = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" database/sql driver
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// PlaylistConfig selects where playlist_id requests get their provider
+// credentials. Set at most one of DatabaseURL and CallbackURL.
+type PlaylistConfig struct {
+	DatabaseURL string        // Postgres DSN of the API database
+	CallbackURL string        // API endpoint, "{id}" is replaced by the playlist id
+	CacheTTL    time.Duration // how long a looked up playlist is reused
+}
+
+// errPlaylistNotFound covers unknown, inactive and foreign playlists alike,
+// so callers cannot probe for other users' playlist ids
+var errPlaylistNotFound = errors.New("playlist not found")
+
+// playlistCredentials are the provider details stored with a playlist
+type playlistCredentials struct {
+	OwnerID  string
+	BaseURL  string
+	Username string
+	Password string
+}
+
+// CredentialSource looks up the provider credentials of a playlist
+type CredentialSource interface {
+	Lookup(ctx context.Context, playlistID string) (playlistCredentials, error)
+}
+
+// newCredentialSource builds the source described by config, or nil when
+// playlist lookups are not configured
+func newCredentialSource(config PlaylistConfig) (CredentialSource, error) {
+	var source CredentialSource
+	switch {
+	case config.DatabaseURL != "" && config.CallbackURL != "":
+		return nil, errors.New("set either a playlist database URL or a callback URL, not both")
+	case config.DatabaseURL != "":
+		db, err := sql.Open("pgx", config.DatabaseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid playlist database URL: %w", redactError(err))
+		}
+		db.SetMaxOpenConns(4)
+		db.SetConnMaxIdleTime(5 * time.Minute)
+		source = &postgresSource{db: db}
+	case config.CallbackURL != "":
+		if !strings.Contains(config.CallbackURL, "{id}") {
+			return nil, errors.New(`playlist callback URL must contain "{id}"`)
+		}
+		// Not the upstream client: the API is an internal service
+		source = &callbackSource{url: config.CallbackURL, client: &http.Client{Timeout: 5 * time.Second}}
+	default:
+		return nil, nil
+	}
+
+	if config.CacheTTL > 0 {
+		source = newCachedSource(source, config.CacheTTL)
+	}
+	return source, nil
+}
+
+// postgresSource reads the API's playlists table directly
+type postgresSource struct {
+	db *sql.DB
+}
+
+func (p *postgresSource) Lookup(ctx context.Context, playlistID string) (playlistCredentials, error) {
+	var creds playlistCredentials
+	err := p.db.QueryRowContext(ctx,
+		`SELECT user_id::text, url, username, password FROM playlists WHERE id::text = $1 AND is_active`,
+		playlistID,
+	).Scan(&creds.OwnerID, &creds.BaseURL, &creds.Username, &creds.Password)
+	if errors.Is(err, sql.ErrNoRows) {
+		return creds, errPlaylistNotFound
+	}
+	if err != nil {
+		return creds, fmt.Errorf("playlist lookup failed: %w", err)
+	}
+	return creds, nil
+}
+
+// apiPlaylistNotFound is the message of the API's GET /playlists/:id when
+// the caller has no such playlist
+const apiPlaylistNotFound = "Playlist not found"
+
+// callbackSource asks the API for the playlist, forwarding the caller's
+// token so the API applies its own ownership rules as well
+type callbackSource struct {
+	url    string
+	client *http.Client
+}
+
+// Close releases the database pool once a reload replaced the source
+func (p *postgresSource) Close() error {
+	return p.db.Close()
+}
+
+func (c *callbackSource) Lookup(ctx context.Context, playlistID string) (playlistCredentials, error) {
+	var creds playlistCredentials
+
+	target := strings.ReplaceAll(c.url, "{id}", url.PathEscape(playlistID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return creds, fmt.Errorf("playlist lookup failed: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if user, ok := userFromContext(ctx); ok {
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+	}
+	// The API joins the caller's trace
+	traceContext.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return creds, fmt.Errorf("playlist lookup failed: %w", redactError(err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		// 400 is the API's request validation, 401 a token it does not take
+		return creds, errPlaylistNotFound
+	default:
+		// The API throws a plain Error for a playlist that does not exist or
+		// belongs to someone else, which its error handler sends as a 500
+		var failure struct {
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 4<<10)).Decode(&failure) == nil && failure.Message == apiPlaylistNotFound {
+			return creds, errPlaylistNotFound
+		}
+		return creds, fmt.Errorf("playlist lookup failed: API returned %d", resp.StatusCode)
+	}
+
+	// Same envelope as every API response
+	var body struct {
+		Success bool `json:"success"`
+		Data    *struct {
+			UserID   string `json:"user_id"`
+			URL      string `json:"url"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			IsActive *bool  `json:"is_active"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return creds, fmt.Errorf("playlist lookup failed: invalid API response: %w", err)
+	}
+	if !body.Success || body.Data == nil || (body.Data.IsActive != nil && !*body.Data.IsActive) {
+		return creds, errPlaylistNotFound
+	}
+
+	return playlistCredentials{
+		OwnerID:  body.Data.UserID,
+		BaseURL:  body.Data.URL,
+		Username: body.Data.Username,
+		Password: body.Data.Password,
+	}, nil
+}
+
+// maxCachedPlaylists bounds the credential cache
+const maxCachedPlaylists = 4096
+
+// cachedSource keeps successful lookups for a short while. Only found
+// playlists are cached; ownership is checked by the caller on every use.
+type cachedSource struct {
+	source CredentialSource
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedPlaylist
+}
+
+func (c *cachedSource) Close() error {
+	if closer, ok := c.source.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type cachedPlaylist struct {
+	creds     playlistCredentials
+	expiresAt time.Time
+}
+
+func newCachedSource(source CredentialSource, ttl time.Duration) *cachedSource {
+	return &cachedSource{source: source, ttl: ttl, entries: make(map[string]cachedPlaylist)}
+}
+
+func (c *cachedSource) Lookup(ctx context.Context, playlistID string) (playlistCredentials, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[playlistID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.creds, nil
+	}
+
+	creds, err := c.source.Lookup(ctx, playlistID)
+	if err != nil {
+		return creds, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedPlaylists {
+		for id, cached := range c.entries {
+			if now.After(cached.expiresAt) {
+				delete(c.entries, id)
+			}
+		}
+		// Still full of live entries: start over rather than grow
+		if len(c.entries) >= maxCachedPlaylists {
+			clear(c.entries)
+		}
+	}
+	c.entries[playlistID] = cachedPlaylist{creds: creds, expiresAt: now.Add(c.ttl)}
+	return creds, nil
+}
+
+// checkPlaylistRequest rejects a playlist_id the proxy could never resolve
+func (s *Server) checkPlaylistRequest(ctx context.Context, playlistID string) error {
+	if s.current().credentials == nil {
+		return &requestError{status: http.StatusBadRequest, code: "PLAYLISTS_DISABLED", message: "playlist_id is not supported by this proxy"}
+	}
+	if _, ok := userFromContext(ctx); !ok {
+		return &requestError{status: http.StatusUnauthorized, code: "UNAUTHORIZED", message: "playlist_id requires an authenticated request"}
+	}
+	// Playlist ids are UUIDs; anything else would only make the API's
+	// database fail the query
+	if !validPlaylistID(playlistID) {
+		return &requestError{status: http.StatusNotFound, code: "PLAYLIST_NOT_FOUND", message: "Playlist not found"}
+	}
+	return nil
+}
+
+// validPlaylistID reports whether id is a UUID in its canonical form
+func validPlaylistID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// resolvePlaylist fills req's credentials from its playlist, which must
+// belong to the authenticated caller. Handlers call it once admitted, so
+// lookups against the API's database or callback are bounded by the pools.
+func (s *Server) resolvePlaylist(ctx context.Context, req *proxyRequest) error {
+	if err := s.checkPlaylistRequest(ctx, req.PlaylistID); err != nil {
+		return err
+	}
+	user, _ := userFromContext(ctx)
+
+	creds, err := s.current().credentials.Lookup(ctx, req.PlaylistID)
+	if err == nil && creds.OwnerID != user.ID {
+		err = errPlaylistNotFound
+	}
+	switch {
+	case errors.Is(err, errPlaylistNotFound):
+		return &requestError{status: http.StatusNotFound, code: "PLAYLIST_NOT_FOUND", message: "Playlist not found"}
+	case err != nil:
+		// The details may describe the database; keep them in the log
+		logFor(ctx).Error("Playlist lookup failed", "playlist_id", req.PlaylistID, "error", err.Error())
+		return &requestError{status: http.StatusBadGateway, code: "PLAYLIST_LOOKUP_FAILED", message: "Playlist lookup failed"}
+	}
+
+	req.BaseURL = creds.BaseURL
+	req.Username = creds.Username
+	req.Password = creds.Password
+	return nil
+}
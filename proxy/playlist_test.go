@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPlaylistID = "6f1c2a9e-0b7d-4c3e-9a51-2d8f4e6b7c10"
+
+func TestCallbackSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   error // nil, errPlaylistNotFound, or any other error
+	}{
+		{"found", 200, `{"success":true,"data":{"user_id":"7","url":"http://panel.example","username":"u","password":"p","is_active":true}}`, nil},
+		{"inactive", 200, `{"success":true,"data":{"user_id":"7","url":"http://panel.example","is_active":false}}`, errPlaylistNotFound},
+		{"unsuccessful", 200, `{"success":false,"data":null}`, errPlaylistNotFound},
+		{"API not found", 500, `{"success":false,"message":"Playlist not found","data":null}`, errPlaylistNotFound},
+		{"404", 404, `{"success":false,"message":"Endpoint not found"}`, errPlaylistNotFound},
+		{"403", 403, ``, errPlaylistNotFound},
+		{"401", 401, ``, errPlaylistNotFound},
+		{"400", 400, `{"success":false,"message":"Invalid id"}`, errPlaylistNotFound},
+		{"API failure", 500, `{"success":false,"message":"connection refused"}`, errors.New("lookup failed")},
+		{"bad gateway", 502, `<html>`, errors.New("lookup failed")},
+		{"bad body", 200, `<html>`, errors.New("lookup failed")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var auth string
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer api.Close()
+			source := &callbackSource{url: api.URL + "/playlists/{id}", client: api.Client()}
+
+			ctx := context.WithValue(context.Background(), authUserKey{}, authUser{ID: "7", Token: "tok"})
+			creds, err := source.Lookup(ctx, testPlaylistID)
+			switch {
+			case tt.want == nil:
+				if err != nil || creds.OwnerID != "7" || creds.Username != "u" {
+					t.Errorf("Lookup = %+v, %v", creds, err)
+				}
+			case errors.Is(tt.want, errPlaylistNotFound):
+				if !errors.Is(err, errPlaylistNotFound) {
+					t.Errorf("Lookup error = %v, want %v", err, errPlaylistNotFound)
+				}
+			default:
+				if err == nil || errors.Is(err, errPlaylistNotFound) {
+					t.Errorf("Lookup error = %v, want a lookup failure", err)
+				}
+			}
+			if auth != "Bearer tok" {
+				t.Errorf("Authorization sent to the API = %q", auth)
+			}
+		})
+	}
+}
+
+// fakeSource counts lookups and answers from a fixed table
+type fakeSource struct {
+	lookups   atomic.Int32
+	playlists map[string]playlistCredentials
+	err       error
+}
+
+func (f *fakeSource) Lookup(ctx context.Context, playlistID string) (playlistCredentials, error) {
+	f.lookups.Add(1)
+	if f.err != nil {
+		return playlistCredentials{}, f.err
+	}
+	creds, ok := f.playlists[playlistID]
+	if !ok {
+		return creds, errPlaylistNotFound
+	}
+	return creds, nil
+}
+
+func TestCachedSource(t *testing.T) {
+	source := &fakeSource{playlists: map[string]playlistCredentials{"a": {OwnerID: "7"}}}
+	cached := newCachedSource(source, 50*time.Millisecond)
+	ctx := context.Background()
+
+	for range 3 {
+		if creds, err := cached.Lookup(ctx, "a"); err != nil || creds.OwnerID != "7" {
+			t.Fatalf("Lookup = %+v, %v", creds, err)
+		}
+	}
+	if n := source.lookups.Load(); n != 1 {
+		t.Errorf("%d lookups within the TTL, want 1", n)
+	}
+
+	// Misses and failures are not cached
+	for range 2 {
+		cached.Lookup(ctx, "missing")
+	}
+	if n := source.lookups.Load(); n != 3 {
+		t.Errorf("%d lookups after two misses, want 3", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	source.err = errors.New("database down")
+	if _, err := cached.Lookup(ctx, "a"); err == nil {
+		t.Error("an expired entry was served instead of looked up again")
+	}
+}
+
+func TestPlaylistOwnership(t *testing.T) {
+	p, allow := newPanel(t)
+	source := &fakeSource{playlists: map[string]playlistCredentials{
+		testPlaylistID: {OwnerID: "7", BaseURL: p.URL, Username: "alice", Password: "secret"},
+	}}
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.Auth.Secret = "sek"
+		c.Playlists.CallbackURL = "http://api.invalid/playlists/{id}"
+	})
+	// Swap in the fake source, cached like the configured one
+	rt := *s.current()
+	rt.credentials = newCachedSource(source, time.Minute)
+	s.rt.Store(&rt)
+
+	request := func(user int, playlistID string) *httptest.ResponseRecorder {
+		token := signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": user, "exp": time.Now().Add(time.Hour).Unix()})
+		r := httptest.NewRequest(http.MethodPost, "/test", strings.NewReader(`{"playlist_id":"`+playlistID+`"}`))
+		r.Header.Set("Authorization", "Bearer "+token)
+		return serve(s, r)
+	}
+
+	if w := request(7, testPlaylistID); w.Code != http.StatusOK {
+		t.Fatalf("owner = %d: %s", w.Code, w.Body)
+	}
+	// The cached entry must not let anyone else in
+	for _, tt := range []struct {
+		name       string
+		user       int
+		playlistID string
+	}{
+		{"another user", 8, testPlaylistID},
+		{"unknown playlist", 7, "00000000-0000-4000-8000-000000000000"},
+		{"not a UUID", 7, "3"},
+	} {
+		w := request(tt.user, tt.playlistID)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), `"PLAYLIST_NOT_FOUND"`) {
+			t.Errorf("%s = %d: %s", tt.name, w.Code, w.Body)
+		}
+	}
+	if n := source.lookups.Load(); n != 2 {
+		t.Errorf("%d lookups, want 2: the owner's, cached, and the unknown id", n)
+	}
+
+	source.err = errors.New("database down")
+	if w := request(7, "00000000-0000-4000-8000-000000000001"); w.Code != http.StatusBadGateway || strings.Contains(w.Body.String(), "database") {
+		t.Errorf("failed lookup = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientLimit is a token bucket: Requests per Window on average, with
+// bursts of up to Burst. Zero Requests disables it.
+type ClientLimit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
+}
+
+// RouteRateLimit holds the budgets of one route. PerIP applies to every
+// request, before authentication; PerUser to authenticated ones after it.
+type RouteRateLimit struct {
+	PerIP   ClientLimit
+	PerUser ClientLimit
+}
+
+// parseClientLimit reads "<requests>/<window>[:<burst>]", e.g. "30/1m:10".
+// "off" or "0" disables the limit; burst defaults to requests.
+func parseClientLimit(value string) (ClientLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "off" || value == "0" {
+		return ClientLimit{}, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(value, ":")
+	count, window, ok := strings.Cut(rate, "/")
+	if !ok {
+		return ClientLimit{}, fmt.Errorf("invalid rate limit %q: want <requests>/<window>[:<burst>]", value)
+	}
+	if window != "" && (window[0] < '0' || window[0] > '9') {
+		window = "1" + window // "30/m" reads as "30/1m"
+	}
+
+	var limit ClientLimit
+	var err error
+	if limit.Requests, err = strconv.Atoi(count); err != nil || limit.Requests < 0 {
+		return ClientLimit{}, fmt.Errorf("invalid rate limit %q: bad request count", value)
+	}
+	if limit.Window, err = time.ParseDuration(window); err != nil || limit.Window <= 0 {
+		return ClientLimit{}, fmt.Errorf("invalid rate limit %q: bad window", value)
+	}
+	limit.Burst = limit.Requests
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst < 1 {
+			return ClientLimit{}, fmt.Errorf("invalid rate limit %q: bad burst", value)
+		}
+	}
+	return limit, nil
+}
+
+// String formats l the way parseClientLimit reads it
+func (l ClientLimit) String() string {
+	if !l.enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%v:%d", l.Requests, l.Window, l.Burst)
+}
+
+func (l ClientLimit) enabled() bool {
+	return l.Requests > 0 && l.Window > 0
+}
+
+// perSecond is the refill rate of the bucket
+func (l ClientLimit) perSecond() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+func (l ClientLimit) burst() float64 {
+	return float64(max(l.Burst, 1))
+}
+
+// maxClientBuckets bounds the rate limiter's memory even under a flood of
+// distinct clients
+const maxClientBuckets = 100_000
+
+// clientLimiter keeps one token bucket per route and client (IP or user)
+type clientLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*clientBucket
+	lastSweep time.Time
+}
+
+type clientBucket struct {
+	limit  ClientLimit
+	tokens float64
+	last   time.Time
+}
+
+// rateVerdict describes the most constrained bucket of a request
+type rateVerdict struct {
+	allowed    bool
+	limit      ClientLimit
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next request may pass, when denied
+}
+
+func newClientLimiter() *clientLimiter {
+	return &clientLimiter{buckets: make(map[string]*clientBucket), lastSweep: time.Now()}
+}
+
+// allow admits a request only if every keyed bucket has a token, and then
+// takes one from each, so a denied request costs nothing
+func (c *clientLimiter) allow(now time.Time, keys []string, limits []ClientLimit) rateVerdict {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(now)
+
+	buckets := make([]*clientBucket, len(keys))
+	for i, key := range keys {
+		b, ok := c.buckets[key]
+		if !ok || b.limit != limits[i] {
+			b = &clientBucket{limit: limits[i], tokens: limits[i].burst(), last: now}
+			c.buckets[key] = b
+		}
+		b.tokens = min(b.limit.burst(), b.tokens+now.Sub(b.last).Seconds()*b.limit.perSecond())
+		b.last = now
+		buckets[i] = b
+	}
+
+	verdict := rateVerdict{allowed: true, remaining: math.MaxInt}
+	for _, b := range buckets {
+		if b.tokens < 1 {
+			verdict.allowed = false
+			wait := time.Duration((1 - b.tokens) / b.limit.perSecond() * float64(time.Second))
+			verdict.retryAfter = max(verdict.retryAfter, wait)
+		}
+	}
+	if verdict.allowed {
+		for _, b := range buckets {
+			b.tokens--
+		}
+	}
+
+	// Report the bucket with the fewest requests left
+	for _, b := range buckets {
+		if remaining := int(max(b.tokens, 0)); remaining < verdict.remaining {
+			verdict.limit = b.limit
+			verdict.remaining = remaining
+			verdict.reset = time.Duration((b.limit.burst() - b.tokens) / b.limit.perSecond() * float64(time.Second))
+		}
+	}
+	return verdict
+}
+
+// sweep evicts buckets that have refilled completely; they are identical
+// to a fresh bucket. Callers must hold c.mu.
+func (c *clientLimiter) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute && len(c.buckets) < maxClientBuckets {
+		return
+	}
+	c.lastSweep = now
+
+	for key, b := range c.buckets {
+		full := b.tokens + now.Sub(b.last).Seconds()*b.limit.perSecond()
+		if full >= b.limit.burst() {
+			delete(c.buckets, key)
+		}
+	}
+	// Everyone is active: forgetting some budgets beats unbounded growth
+	if len(c.buckets) >= maxClientBuckets {
+		clear(c.buckets)
+	}
+}
+
+type rateVerdictKey struct{}
+
+// rateLimitIP applies the per-IP budget of route. It runs before
+// requireAuth, so a client sending bad or no tokens is limited as well.
+func (s *Server) rateLimitIP(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := s.current().config.RateLimits[route]
+		if limits == nil || !limits.PerIP.enabled() {
+			next(w, r)
+			return
+		}
+
+		verdict := s.clients.allow(time.Now(), []string{route + "|ip|" + s.clientIP(r).String()}, []ClientLimit{limits.PerIP})
+		setRateLimitHeaders(w, verdict)
+		if !verdict.allowed {
+			s.writeRateLimited(w, verdict)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), rateVerdictKey{}, verdict)))
+	}
+}
+
+// rateLimitUser applies the per-user budget of route. It runs after
+// requireAuth so the user id is known; anonymous requests skip it. The
+// headers describe whichever of the IP and user buckets has fewer
+// requests left.
+func (s *Server) rateLimitUser(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limits := s.current().config.RateLimits[route]
+		user, ok := userFromContext(r.Context())
+		if !ok || limits == nil || !limits.PerUser.enabled() {
+			next(w, r)
+			return
+		}
+
+		verdict := s.clients.allow(time.Now(), []string{route + "|user|" + user.ID}, []ClientLimit{limits.PerUser})
+		report := verdict
+		if byIP, ok := r.Context().Value(rateVerdictKey{}).(rateVerdict); ok && verdict.allowed && byIP.remaining < verdict.remaining {
+			report = byIP
+		}
+		setRateLimitHeaders(w, report)
+		if !verdict.allowed {
+			s.writeRateLimited(w, verdict)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// writeRateLimited answers a request denied by verdict
+func (s *Server) writeRateLimited(w http.ResponseWriter, verdict rateVerdict) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(verdict.retryAfter.Seconds()))))
+	s.writeJSON(w, http.StatusTooManyRequests, ProxyResponse{
+		Success: false,
+		Code:    "RATE_LIMITED",
+		Message: "Too many requests, please slow down",
+		Data:    nil,
+	})
+}
+
+// setRateLimitHeaders sends the IETF RateLimit header fields
+func setRateLimitHeaders(w http.ResponseWriter, v rateVerdict) {
+	h := w.Header()
+	h.Set("RateLimit-Limit", strconv.Itoa(v.limit.Burst))
+	h.Set("RateLimit-Remaining", strconv.Itoa(v.remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(v.reset.Seconds()))))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", v.limit.Requests, int(v.limit.Window.Seconds()), v.limit.Burst))
+}
+
+// clientIP is the address of the client. X-Forwarded-For is only believed
+// when the connection comes from a trusted proxy, and then read from the
+// right, skipping further trusted proxies.
+func (s *Server) clientIP(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr = addr.Unmap()
+	if !s.trustedProxy(addr) {
+		return addr
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !s.trustedProxy(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+func (s *Server) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.current().trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseClientLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ClientLimit
+		wantErr bool
+	}{
+		{"30/1m:10", ClientLimit{30, time.Minute, 10}, false},
+		{"30/m", ClientLimit{30, time.Minute, 30}, false},
+		{" 5/10s ", ClientLimit{5, 10 * time.Second, 5}, false},
+		{"off", ClientLimit{}, false},
+		{"0", ClientLimit{}, false},
+		{"30", ClientLimit{}, true},
+		{"x/1m", ClientLimit{}, true},
+		{"30/0s", ClientLimit{}, true},
+		{"30/1m:0", ClientLimit{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClientLimit(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseClientLimit(%q) = %+v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	c := newClientLimiter()
+	limit := ClientLimit{Requests: 60, Window: time.Minute, Burst: 2}
+	now := time.Now()
+	allow := func(at time.Duration, keys ...string) rateVerdict {
+		limits := make([]ClientLimit, len(keys))
+		for i := range keys {
+			limits[i] = limit
+		}
+		return c.allow(now.Add(at), keys, limits)
+	}
+
+	for i := range 2 {
+		if v := allow(0, "a"); !v.allowed || v.remaining != 1-i {
+			t.Fatalf("request %d of the burst = %+v", i, v)
+		}
+	}
+	v := allow(0, "a")
+	if v.allowed || v.retryAfter != time.Second {
+		t.Fatalf("request past the burst = %+v, want denied for 1s", v)
+	}
+	if v := allow(time.Second, "a"); !v.allowed {
+		t.Errorf("request after a refill = %+v", v)
+	}
+
+	// A request denied by one bucket takes nothing from the others
+	if v := allow(time.Second, "a", "b"); v.allowed {
+		t.Fatalf("request with an empty bucket = %+v", v)
+	}
+	if v := allow(time.Second, "b"); !v.allowed || v.remaining != 1 {
+		t.Errorf("bucket b after a denied request = %+v, want a full burst", v)
+	}
+}
+
+func TestBucketEviction(t *testing.T) {
+	c := newClientLimiter()
+	limit := ClientLimit{Requests: 1, Window: time.Minute, Burst: 1}
+	now := time.Now()
+	c.allow(now, []string{"idle"}, []ClientLimit{limit})
+	c.allow(now.Add(90*time.Second), []string{"busy"}, []ClientLimit{{Requests: 1, Window: time.Hour, Burst: 1}})
+
+	// idle refilled completely and goes; busy is still empty and stays
+	c.allow(now.Add(3*time.Minute), []string{"other"}, []ClientLimit{limit})
+	c.mu.Lock()
+	_, idle := c.buckets["idle"]
+	_, busy := c.buckets["busy"]
+	c.mu.Unlock()
+	if idle || !busy {
+		t.Errorf("after a sweep idle kept = %v, busy kept = %v; want false, true", idle, busy)
+	}
+
+	// Once every bucket is in use the limiter forgets them all
+	c.mu.Lock()
+	for i := range maxClientBuckets {
+		c.buckets[strconv.Itoa(i)+"|flood"] = &clientBucket{limit: limit, last: now.Add(3 * time.Minute)}
+	}
+	c.mu.Unlock()
+	c.allow(now.Add(3*time.Minute), []string{"next"}, []ClientLimit{limit})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.buckets) != 1 {
+		t.Errorf("%d buckets after a flood, want 1", len(c.buckets))
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/8"} })
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"trusted peer", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left hop", "10.0.0.1:1234", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2", "10.0.0.3"}, "198.51.100.1"},
+		{"garbage hop", "10.0.0.1:1234", []string{"198.51.100.1, junk"}, "10.0.0.1"},
+		{"mapped peer", "[::ffff:203.0.113.5]:1234", nil, "203.0.113.5"},
+		{"mapped hop", "10.0.0.1:1234", []string{"::ffff:198.51.100.1"}, "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/get", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := s.clientIP(r); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientIP = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitOrder(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.Auth.Secret = "sek"
+		c.RateLimits["/test"] = &RouteRateLimit{
+			PerIP:   ClientLimit{Requests: 3, Window: time.Hour, Burst: 3},
+			PerUser: ClientLimit{Requests: 1, Window: time.Hour, Burst: 1},
+		}
+	})
+	token := func(user int) string {
+		return signHS256(t, "sek", map[string]any{"alg": "HS256"}, map[string]any{"userId": user, "exp": time.Now().Add(time.Hour).Unix()})
+	}
+	request := func(ip, bearer string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/test", nil)
+		r.RemoteAddr = ip + ":1234"
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		return serve(s, r)
+	}
+
+	// The per-user bucket follows the user across addresses
+	w := request("203.0.113.1", token(1))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("first request = %d: %s", w.Code, w.Body)
+	}
+	// The headers describe the tighter of the two buckets
+	if got := w.Header().Get("RateLimit-Policy"); got != "1;w=3600;burst=1" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("headers report %s with %s left, want the user bucket", got, w.Header().Get("RateLimit-Remaining"))
+	}
+	if w := request("203.0.113.2", token(1)); w.Code != http.StatusTooManyRequests {
+		t.Errorf("user over budget from another IP = %d, want 429", w.Code)
+	}
+	if w := request("203.0.113.2", token(2)); w.Code != http.StatusBadRequest {
+		t.Errorf("another user = %d, want 400", w.Code)
+	}
+
+	// Requests without a valid token spend the IP budget before auth
+	for range 3 {
+		if w := request("203.0.113.3", "bad"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("bad token = %d, want 401", w.Code)
+		}
+	}
+	if w := request("203.0.113.3", "bad"); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("bad tokens past the IP budget = %d, want 429 with Retry-After", w.Code)
+	}
+}
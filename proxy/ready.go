@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadyConfig tunes /ready. The canary is optional; without a URL only
+// shutdown and capacity are checked.
+type ReadyConfig struct {
+	MaxSaturation  float64       // share of concurrency slots in use above which the proxy is not ready
+	CanaryURL      string        // fetched through the upstream client to prove DNS and egress work
+	CanaryInterval time.Duration // time between canary checks
+	CanaryTimeout  time.Duration
+}
+
+// canaryResult is the outcome of the latest canary check
+type canaryResult struct {
+	checked   bool
+	ok        bool
+	checkedAt time.Time
+	latency   time.Duration
+	status    int
+	err       string
+}
+
+// canaryState is written by the check loop and read by /ready
+type canaryState struct {
+	mu     sync.Mutex
+	result canaryResult
+}
+
+func (c *canaryState) get() canaryResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.result
+}
+
+func (c *canaryState) set(result canaryResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.result = result
+}
+
+// runCanary checks the canary URL every interval until the server stops.
+// The settings are re-read each round so a reload takes effect.
+func (s *Server) runCanary() {
+	for {
+		config := s.current().config.Ready
+		if config.CanaryURL != "" {
+			s.canary.set(s.checkCanary(config))
+		} else {
+			s.canary.set(canaryResult{})
+		}
+
+		select {
+		case <-s.workCtx.Done():
+			return
+		case <-time.After(config.CanaryInterval):
+		}
+	}
+}
+
+// checkCanary fetches the canary URL once. Any answer below 500 counts:
+// the point is that the proxy can reach the outside world.
+func (s *Server) checkCanary(config ReadyConfig) canaryResult {
+	ctx, cancel := context.WithTimeout(s.workCtx, config.CanaryTimeout)
+	defer cancel()
+
+	result := canaryResult{checked: true, checkedAt: time.Now()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.CanaryURL, nil)
+	if err != nil {
+		result.err = err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", "SyncStream-Proxy/1.0")
+
+	resp, err := s.current().client.Do(req)
+	result.latency = time.Since(result.checkedAt)
+	if err != nil {
+		result.err = redactError(err).Error()
+		slog.Warn("Readiness canary failed", "error", result.err)
+		return result
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	result.status = resp.StatusCode
+	if resp.StatusCode >= http.StatusInternalServerError {
+		result.err = fmt.Sprintf("canary answered %s", resp.Status)
+		slog.Warn("Readiness canary failed", "status", resp.StatusCode)
+		return result
+	}
+	result.ok = true
+	return result
+}
+
+// Readiness check endpoint: whether this instance should receive traffic
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	config := s.current().config.Ready
+	ready := true
+	components := make(map[string]any)
+
+	shutdown := map[string]any{"status": "ok"}
+	if s.draining.Load() {
+		shutdown["status"] = "draining"
+		ready = false
+	}
+	components["shutdown"] = shutdown
+
+	inUse, capacity, queued := s.admission.stats()
+	saturation := float64(inUse) / float64(capacity)
+	slots := map[string]any{
+		"status":        "ok",
+		"inUse":         inUse,
+		"capacity":      capacity,
+		"queued":        queued,
+		"pools":         s.admission.poolStats(),
+		"saturation":    saturation,
+		"maxSaturation": config.MaxSaturation,
+	}
+	if saturation >= config.MaxSaturation {
+		slots["status"] = "saturated"
+		ready = false
+	}
+	components["capacity"] = slots
+
+	if config.CanaryURL != "" {
+		result := s.canary.get()
+		canary := map[string]any{"status": "ok", "url": redact(config.CanaryURL)}
+		switch {
+		case !result.checked:
+			// Not ready until the network has been proven once
+			canary["status"] = "pending"
+			ready = false
+		case !result.ok:
+			canary["status"] = "failing"
+			canary["error"] = result.err
+			ready = false
+		}
+		if result.checked {
+			canary["checkedAt"] = result.checkedAt.Unix()
+			canary["latencyMs"] = ms(result.latency)
+			if result.status != 0 {
+				canary["httpStatus"] = result.status
+			}
+		}
+		components["canary"] = canary
+	}
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	s.writeJSON(w, code, map[string]any{
+		"status":     status,
+		"time":       time.Now().Unix(),
+		"components": components,
+	})
+}
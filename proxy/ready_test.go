@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// getReady serves /ready and returns its status code and components
+func getReady(t *testing.T, s *Server) (int, map[string]map[string]any) {
+	t.Helper()
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var body struct {
+		Status     string                    `json:"status"`
+		Components map[string]map[string]any `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("/ready body %q: %v", w.Body, err)
+	}
+	if want := map[int]string{200: "ready", 503: "not_ready"}[w.Code]; body.Status != want {
+		t.Errorf("/ready = %d %q", w.Code, body.Status)
+	}
+	return w.Code, body.Components
+}
+
+func TestReadyWhileDraining(t *testing.T) {
+	s := newTestServer(t, nil)
+	if code, components := getReady(t, s); code != http.StatusOK || components["shutdown"]["status"] != "ok" {
+		t.Fatalf("/ready = %d %v, want ready", code, components)
+	}
+
+	s.draining.Store(true)
+	code, components := getReady(t, s)
+	if code != http.StatusServiceUnavailable || components["shutdown"]["status"] != "draining" {
+		t.Errorf("/ready while draining = %d %v", code, components["shutdown"])
+	}
+	if _, ok := components["canary"]; ok {
+		t.Error("canary reported without ready.canary_url")
+	}
+}
+
+func TestReadyAtSaturation(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.MaxConcurrent = 4
+		c.Pools = map[string]*PoolConfig{"/get": {Size: 4}, "/test": {Size: 1}}
+		c.Ready.MaxSaturation = 0.5
+	})
+
+	var releases []func()
+	for range 2 {
+		release, _, err := s.admission.acquire(context.Background(), "/get", 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		releases = append(releases, release)
+	}
+	code, components := getReady(t, s)
+	capacity := components["capacity"]
+	if code != http.StatusServiceUnavailable || capacity["status"] != "saturated" || capacity["inUse"] != 2.0 || capacity["saturation"] != 0.5 {
+		t.Errorf("/ready at half capacity = %d %v, want saturated", code, capacity)
+	}
+
+	releases[0]()
+	if code, components := getReady(t, s); code != http.StatusOK || components["capacity"]["status"] != "ok" {
+		t.Errorf("/ready below max_saturation = %d %v", code, components["capacity"])
+	}
+	releases[1]()
+}
+
+func TestReadyCanary(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	upstream, allow := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	})
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.Ready.CanaryURL = upstream.URL
+		c.Ready.CanaryInterval = 10 * time.Millisecond
+	})
+
+	waitCanary := func(want string) map[string]any {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, components := getReady(t, s); components["canary"]["status"] == want {
+				return components["canary"]
+			}
+		}
+		t.Fatalf("canary never became %s", want)
+		return nil
+	}
+
+	canary := waitCanary("ok")
+	if canary["httpStatus"] != 200.0 {
+		t.Errorf("canary = %v", canary)
+	}
+	// Any answer below 500 proves the network works
+	status.Store(http.StatusNotFound)
+	time.Sleep(50 * time.Millisecond)
+	waitCanary("ok")
+
+	status.Store(http.StatusBadGateway)
+	canary = waitCanary("failing")
+	if code, _ := getReady(t, s); code != http.StatusServiceUnavailable {
+		t.Errorf("/ready with a failing canary = %d, want 503", code)
+	}
+	if canary["httpStatus"] != 502.0 || !strings.Contains(canary["error"].(string), "502") {
+		t.Errorf("failing canary = %v", canary)
+	}
+
+	status.Store(http.StatusOK)
+	waitCanary("ok")
+}
+
+func TestReadyCanaryUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	canaryURL := "http://probe:hunter2@" + ln.Addr().String() + "/"
+	ln.Close()
+
+	s := newTestServer(t, func(c *Config) {
+		c.Egress.Allowed = []string{"127.0.0.1/32"}
+		c.Ready.CanaryURL = canaryURL
+		c.Ready.CanaryInterval = time.Hour
+	})
+	// Let the startup check land, then rewind to before it finished
+	for !s.canary.get().checked {
+		time.Sleep(time.Millisecond)
+	}
+	s.canary.set(canaryResult{})
+	if code, components := getReady(t, s); code != http.StatusServiceUnavailable || components["canary"]["status"] != "pending" {
+		t.Errorf("/ready before the first check = %d %v, want pending", code, components["canary"])
+	}
+
+	s.canary.set(s.checkCanary(s.current().config.Ready))
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"failing"`) {
+		t.Errorf("/ready with an unreachable canary = %d %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), "hunter2") {
+		t.Errorf("/ready shows the canary password: %s", w.Body)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// sourceCloseDelay is how long a replaced playlist source stays open for
+// lookups that started before the reload
+var sourceCloseDelay = time.Minute
+
+// runtime is everything derived from the configuration that a reload can
+// replace. Handlers read it once through Server.current and keep using that
+// snapshot, so a request never sees half of an old and half of a new config.
+type runtime struct {
+	config         *Config
+	client         *http.Client // upstream client, dialing through egress
+	retry          RetryPolicy
+	cors           *corsPolicy
+	trustedProxies []netip.Prefix
+	verifier       *jwtVerifier     // nil when authentication is off
+	credentials    CredentialSource // nil when playlist_id is not supported
+}
+
+// newRuntime builds the swappable state for config. The playlist source is
+// carried over from prev when its settings did not change.
+func newRuntime(config *Config, prev *runtime) (*runtime, error) {
+	egress, err := newEgressPolicy(config.Egress)
+	if err != nil {
+		return nil, err
+	}
+	cors, err := newCORSPolicy(config.CORS)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	rt := &runtime{
+		config: config,
+		// Create HTTP client with sensible defaults for upstream requests
+		client: &http.Client{
+			Timeout: config.UpstreamTimeout,
+			Transport: &http.Transport{
+				MaxIdleConns:        config.UpstreamMaxIdleConns,
+				MaxIdleConnsPerHost: config.UpstreamMaxIdleConnsPerHost,
+				IdleConnTimeout:     config.UpstreamIdleConnTimeout,
+				DisableKeepAlives:   false,
+				DialContext: (&net.Dialer{
+					Timeout:   config.UpstreamDialTimeout,
+					KeepAlive: config.UpstreamKeepAlive,
+					Control:   egress.control, // checked on every resolved IP
+				}).DialContext,
+			},
+		},
+		retry:          newBackoffPolicy(config.MaxRetries, config.RetryDelay, config.RetryMaxDelay),
+		cors:           cors,
+		trustedProxies: trustedProxies,
+	}
+
+	if config.Auth.enabled() {
+		// Re-reads the JWKS file, so keys can be rotated with a reload
+		if rt.verifier, err = newJWTVerifier(config.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && prev.config.Playlists == config.Playlists {
+		rt.credentials = prev.credentials
+	} else if rt.credentials, err = newCredentialSource(config.Playlists); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// current returns the live runtime
+func (s *Server) current() *runtime {
+	return s.rt.Load()
+}
+
+// ReloadResult lists the settings a reload changed, by key
+type ReloadResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"` // changed, but kept at the running value
+}
+
+// Reload swaps in config. Settings that only take effect on restart keep
+// their running values and are reported in RestartRequired. On error the
+// running configuration is left untouched.
+func (s *Server) Reload(config *Config) (ReloadResult, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.current()
+	result := ReloadResult{Applied: []string{}, RestartRequired: []string{}}
+	for _, st := range settings {
+		if st.equal(old.config, config) {
+			continue
+		}
+		if st.restart {
+			st.copy(config, old.config)
+			result.RestartRequired = append(result.RestartRequired, st.key)
+		} else {
+			result.Applied = append(result.Applied, st.key)
+		}
+	}
+	if !maps.Equal(old.config.UpstreamHostLimits, config.UpstreamHostLimits) && !slices.Contains(result.Applied, "upstream.limits_file") {
+		result.Applied = append(result.Applied, "upstream.limits_file")
+	}
+
+	if problems := config.validate(); len(problems) > 0 {
+		return result, fmt.Errorf("invalid configuration:\n  %w", joinLines(problems))
+	}
+	rt, err := newRuntime(config, old)
+	if err != nil {
+		return result, err
+	}
+
+	// Stateful components keep their state and pick up the new limits
+	s.upstream.setLimits(config.UpstreamLimit, config.UpstreamHostLimits)
+	s.breakers.setConfig(config.Breaker)
+	s.admission.setPools(config.Pools)
+	if s.cache != nil {
+		s.cache.setFreshness(config.CacheTTL, config.CacheStaleWindow)
+	}
+
+	s.rt.Store(rt)
+	if level, err := parseLogLevel(config.LogLevel); err == nil {
+		logLevel.Set(level)
+	}
+
+	// Requests still holding the old runtime finish on its client
+	old.client.CloseIdleConnections()
+	if old.credentials != rt.credentials {
+		if closer, ok := old.credentials.(io.Closer); ok {
+			go func() {
+				// Give in-flight lookups a moment before closing the pool
+				time.Sleep(sourceCloseDelay)
+				closer.Close()
+			}()
+		}
+	}
+	return result, nil
+}
+
+// reloadConfig re-reads the configuration sources and applies them,
+// logging the outcome. A bad configuration leaves the server running as is.
+func (s *Server) reloadConfig() (ReloadResult, error) {
+	if s.loadConfig == nil {
+		return ReloadResult{}, errors.New("configuration reload is not available")
+	}
+
+	config, err := s.loadConfig()
+	if err == nil {
+		var result ReloadResult
+		if result, err = s.Reload(config); err == nil {
+			slog.Info("Configuration reloaded", "applied", result.Applied, "restart_required", result.RestartRequired)
+			return result, nil
+		}
+	}
+	slog.Error("Configuration reload failed, keeping the running configuration", "error", err.Error())
+	return ReloadResult{}, err
+}
+
+// handleReload reloads the configuration on POST /admin/reload
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeMethodNotAllowed(w, "POST")
+		return
+	}
+
+	result, err := s.reloadConfig()
+	if err != nil {
+		s.writeJSON(w, http.StatusUnprocessableEntity, ProxyResponse{
+			Success: false,
+			Code:    "CONFIG_INVALID",
+			Message: err.Error(),
+			Data:    nil,
+		})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Message: "Configuration reloaded",
+		Data:    result,
+	})
+}
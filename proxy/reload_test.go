@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// closingSource is a playlist source that reports when it is closed
+type closingSource struct {
+	fakeSource
+	closed chan struct{}
+}
+
+func (c *closingSource) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestReloadKeepsRestartSettings(t *testing.T) {
+	s := newTestServer(t, nil)
+	before := s.current()
+
+	config := DefaultConfig()
+	config.Addr = ":9999"
+	config.ReadTimeout = time.Second
+	config.MaxRetries = 9
+	config.LogLevel = "debug"
+	t.Cleanup(func() { logLevel.Set(0) })
+	result, err := s.Reload(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"retry.max_retries", "log.level"}; !sameKeys(result.Applied, want) {
+		t.Errorf("Applied = %q, want %q", result.Applied, want)
+	}
+	if want := []string{"server.addr", "server.read_timeout"}; !sameKeys(result.RestartRequired, want) {
+		t.Errorf("RestartRequired = %q, want %q", result.RestartRequired, want)
+	}
+	after := s.current().config
+	if after.Addr != before.config.Addr || after.ReadTimeout != before.config.ReadTimeout {
+		t.Errorf("restart-only settings changed to %q, %v", after.Addr, after.ReadTimeout)
+	}
+	if after.MaxRetries != 9 {
+		t.Errorf("retry.max_retries = %d after reload, want 9", after.MaxRetries)
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	s := newTestServer(t, nil)
+	before := s.current()
+
+	invalid := DefaultConfig()
+	invalid.MaxRetries = 9
+	invalid.RetryMaxDelay = time.Millisecond // below retry.base_delay
+	if _, err := s.Reload(invalid); err == nil {
+		t.Fatal("Reload accepted an invalid configuration")
+	}
+	if s.current() != before || before.config.MaxRetries != DefaultConfig().MaxRetries {
+		t.Error("a rejected reload changed the running configuration")
+	}
+
+	// Same through /admin/reload, with a file that does not parse
+	file := writeConfig(t, "retry:\n  max_retries: 9\n  base_delay: [\n")
+	s.loadConfig = func() (*Config, error) {
+		config, _, err := LoadConfig(nil, envOf(map[string]string{"PROXY_CONFIG_FILE": file}))
+		return config, err
+	}
+	w := httptest.NewRecorder()
+	s.handleReload(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /admin/reload = %d, want 422", w.Code)
+	}
+	if s.current() != before {
+		t.Error("a failed /admin/reload changed the running configuration")
+	}
+}
+
+func TestReloadClosesReplacedPlaylistSource(t *testing.T) {
+	old := sourceCloseDelay
+	sourceCloseDelay = 0
+	t.Cleanup(func() { sourceCloseDelay = old })
+
+	configure := func(c *Config) {
+		c.Auth.Secret = "test-secret"
+		c.Playlists.CallbackURL = "http://api.internal/playlists/{id}"
+	}
+	s := newTestServer(t, configure)
+	source := &closingSource{closed: make(chan struct{})}
+	s.current().credentials = source
+
+	// Unchanged playlist settings keep the source open
+	same := DefaultConfig()
+	configure(same)
+	same.MaxRetries = 9
+	if _, err := s.Reload(same); err != nil {
+		t.Fatal(err)
+	}
+	if s.current().credentials != source {
+		t.Fatal("reload replaced a playlist source whose settings did not change")
+	}
+
+	changed := DefaultConfig()
+	configure(changed)
+	changed.Playlists.CallbackURL = "http://api2.internal/playlists/{id}"
+	if _, err := s.Reload(changed); err != nil {
+		t.Fatal(err)
+	}
+	if s.current().credentials == source {
+		t.Fatal("reload kept the playlist source after its settings changed")
+	}
+	select {
+	case <-source.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replaced playlist source was never closed")
+	}
+}
+
+// sameKeys reports whether got holds exactly the keys in want, in any order
+func sameKeys(got, want []string) bool {
+	return len(got) == len(want) && !slices.ContainsFunc(want, func(k string) bool { return !slices.Contains(got, k) })
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Query string credential policies, see Config.QueryCredentials
+const (
+	queryCredentialsAllow      = "allow"
+	queryCredentialsDeprecated = "deprecated" // still accepted, but flagged
+	queryCredentialsDeny       = "deny"
+)
+
+// Headers carrying credentials as an alternative to the JSON body
+const (
+	headerBaseURL  = "X-Xtream-Base-URL"
+	headerUsername = "X-Xtream-Username"
+	headerPassword = "X-Xtream-Password"
+)
+
+// maxRequestBody bounds the JSON body of POST /get and /test
+const maxRequestBody = 16 << 10
+
+// proxyRequest holds the provider credentials and options of /get and /test.
+// POST requests send it as a JSON body.
+type proxyRequest struct {
+	BaseURL    string `json:"base_url"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	PlaylistID string `json:"playlist_id,omitempty"` // replaces the three above, see resolvePlaylist
+	Cache      string `json:"cache,omitempty"`       // "bypass" skips the catalog cache
+	Since      string `json:"since,omitempty"`       // snapshot id for a delta response
+}
+
+// requestError is a client error with its HTTP status and error code
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *requestError) Error() string { return e.message }
+
+// readProxyRequest collects credentials from, in order of preference, a
+// playlist_id, a POST JSON body, the X-Xtream-* headers, or the query string
+// when the QueryCredentials policy allows it. Options may always come from
+// the query.
+func (s *Server) readProxyRequest(w http.ResponseWriter, r *http.Request) (proxyRequest, error) {
+	var req proxyRequest
+
+	switch r.Method {
+	case http.MethodPost:
+		body := http.MaxBytesReader(w, r.Body, maxRequestBody)
+		if err := json.NewDecoder(body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			return req, &requestError{status: http.StatusBadRequest, code: "INVALID_BODY", message: "Invalid JSON body"}
+		}
+	case http.MethodGet:
+	default:
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		return req, &requestError{status: http.StatusMethodNotAllowed, code: "METHOD_NOT_ALLOWED", message: "Method not allowed"}
+	}
+
+	query := r.URL.Query()
+	if req.PlaylistID == "" {
+		req.PlaylistID = strings.TrimSpace(query.Get("playlist_id"))
+	}
+	if req.PlaylistID != "" {
+		// Only the cheap checks here: the lookup itself waits for admission,
+		// see resolvePlaylist
+		req.BaseURL, req.Username, req.Password = "", "", ""
+		if err := s.checkPlaylistRequest(r.Context(), req.PlaylistID); err != nil {
+			return req, err
+		}
+	}
+
+	if req.BaseURL == "" && req.Username == "" && req.Password == "" {
+		req.BaseURL = r.Header.Get(headerBaseURL)
+		req.Username = r.Header.Get(headerUsername)
+		req.Password = r.Header.Get(headerPassword)
+	}
+
+	if req.BaseURL == "" && req.Username == "" && req.Password == "" && query.Has("password") {
+		switch s.current().config.QueryCredentials {
+		case queryCredentialsDeny:
+			return req, &requestError{
+				status:  http.StatusBadRequest,
+				code:    "QUERY_CREDENTIALS_DISABLED",
+				message: "Credentials in the query string are disabled; send them in a POST body or X-Xtream-* headers",
+			}
+		case queryCredentialsDeprecated:
+			w.Header().Set("Deprecation", "true")
+			logFor(r.Context()).Warn("Deprecated query string credentials", "path", r.URL.Path)
+		}
+		req.BaseURL = query.Get("base_url")
+		req.Username = query.Get("username")
+		req.Password = query.Get("password")
+	}
+
+	if req.Cache == "" {
+		req.Cache = query.Get("cache")
+	}
+	if req.Since == "" {
+		req.Since = query.Get("since")
+	}
+
+	req.BaseURL = strings.TrimSpace(req.BaseURL)
+	req.Username = strings.TrimSpace(req.Username)
+	req.Password = strings.TrimSpace(req.Password)
+	if req.PlaylistID == "" && (req.BaseURL == "" || req.Username == "" || req.Password == "") {
+		return req, &requestError{status: http.StatusBadRequest, message: "Missing required parameters: base_url, username, password (or playlist_id)"}
+	}
+	return req, nil
+}
+
+// playerAuthURL checks req's base URL and builds its authentication URL,
+// answering the client when either fails
+func (s *Server) playerAuthURL(w http.ResponseWriter, req proxyRequest) (string, bool) {
+	if _, err := url.Parse(req.BaseURL); err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Message: "Invalid base_url format",
+			Data:    nil,
+		})
+		return "", false
+	}
+	authURL, err := s.buildPlayerURL(req.BaseURL, req.Username, req.Password, nil)
+	if err != nil {
+		s.writeJSON(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Message: fmt.Sprintf("Failed to build auth URL: %v", err),
+			Data:    nil,
+		})
+		return "", false
+	}
+	return authURL, true
+}
+
+// writeRequestError reports an error from readProxyRequest
+func (s *Server) writeRequestError(w http.ResponseWriter, err error) {
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		reqErr = &requestError{status: http.StatusBadRequest, message: err.Error()}
+	}
+	s.writeJSON(w, reqErr.status, ProxyResponse{
+		Success: false,
+		Code:    reqErr.code,
+		Message: reqErr.message,
+		Data:    nil,
+	})
+}
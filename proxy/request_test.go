@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyRequest(t *testing.T) {
+	const query = "/get?base_url=http://query.example&username=qu&password=qp&cache=bypass&since=s1"
+	body := func(json string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/get", strings.NewReader(json))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+	withHeaders := func(r *http.Request) *http.Request {
+		r.Header.Set(headerBaseURL, "http://header.example")
+		r.Header.Set(headerUsername, "hu")
+		r.Header.Set(headerPassword, "hp")
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		req    *http.Request
+		want   proxyRequest
+		status int    // of the error, 0 for none
+		code   string // of the error
+	}{
+		{"body", queryCredentialsAllow, body(`{"base_url":" http://body.example ","username":"bu","password":"bp","cache":"bypass"}`),
+			proxyRequest{BaseURL: "http://body.example", Username: "bu", Password: "bp", Cache: "bypass"}, 0, ""},
+		{"headers", queryCredentialsAllow, withHeaders(httptest.NewRequest(http.MethodGet, "/get", nil)),
+			proxyRequest{BaseURL: "http://header.example", Username: "hu", Password: "hp"}, 0, ""},
+		{"query", queryCredentialsAllow, httptest.NewRequest(http.MethodGet, query, nil),
+			proxyRequest{BaseURL: "http://query.example", Username: "qu", Password: "qp", Cache: "bypass", Since: "s1"}, 0, ""},
+		{"body over headers and query", queryCredentialsAllow, withHeaders(body(`{"base_url":"http://body.example","username":"bu","password":"bp"}`)),
+			proxyRequest{BaseURL: "http://body.example", Username: "bu", Password: "bp"}, 0, ""},
+		{"headers over query", queryCredentialsAllow, withHeaders(httptest.NewRequest(http.MethodGet, query, nil)),
+			proxyRequest{BaseURL: "http://header.example", Username: "hu", Password: "hp", Cache: "bypass", Since: "s1"}, 0, ""},
+		{"headers with query denied", queryCredentialsDeny, withHeaders(httptest.NewRequest(http.MethodGet, query, nil)),
+			proxyRequest{BaseURL: "http://header.example", Username: "hu", Password: "hp", Cache: "bypass", Since: "s1"}, 0, ""},
+		{"query denied", queryCredentialsDeny, httptest.NewRequest(http.MethodGet, query, nil),
+			proxyRequest{}, http.StatusBadRequest, "QUERY_CREDENTIALS_DISABLED"},
+		{"empty body", queryCredentialsAllow, withHeaders(body(``)),
+			proxyRequest{BaseURL: "http://header.example", Username: "hu", Password: "hp"}, 0, ""},
+		{"invalid body", queryCredentialsAllow, body(`{"password":`), proxyRequest{}, http.StatusBadRequest, "INVALID_BODY"},
+		{"oversized body", queryCredentialsAllow, body(`{"password":"` + strings.Repeat("x", maxRequestBody) + `"}`), proxyRequest{}, http.StatusBadRequest, "INVALID_BODY"},
+		{"missing password", queryCredentialsAllow, body(`{"base_url":"http://body.example","username":"bu"}`), proxyRequest{}, http.StatusBadRequest, ""},
+		{"method", queryCredentialsAllow, httptest.NewRequest(http.MethodPut, "/get", nil), proxyRequest{}, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, func(c *Config) { c.QueryCredentials = tt.policy })
+			got, err := s.readProxyRequest(httptest.NewRecorder(), tt.req)
+			if tt.status != 0 {
+				reqErr, ok := err.(*requestError)
+				if !ok || reqErr.status != tt.status || reqErr.code != tt.code {
+					t.Fatalf("error = %#v, want status %d code %q", err, tt.status, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("request = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeprecatedQueryCredentials(t *testing.T) {
+	s := newTestServer(t, func(c *Config) { c.QueryCredentials = queryCredentialsDeprecated })
+	w := httptest.NewRecorder()
+	if _, err := s.readProxyRequest(w, httptest.NewRequest(http.MethodGet, "/get?base_url=http://p&username=u&password=p", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Deprecation") != "true" {
+		t.Error("query credentials accepted without a Deprecation header")
+	}
+}
+
+// A successful POST /get serves the catalog without the password showing up
+// in any log line
+func TestPostCredentials(t *testing.T) {
+	const password = "hunter2-s3cret"
+	var logs bytes.Buffer
+	prevLogger, prevLevel := slog.Default(), logLevel.Level()
+	slog.SetDefault(newLogger(&logs, logFormatJSON))
+	logLevel.Set(slog.LevelDebug)
+	t.Cleanup(func() {
+		slog.SetDefault(prevLogger)
+		logLevel.Set(prevLevel)
+	})
+
+	p, allow := newPanel(t)
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1}]`)
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.QueryCredentials = queryCredentialsDeny
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/get", strings.NewReader(`{"base_url":"`+p.URL+`","username":"alice","password":"`+password+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := serve(s, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /get = %d: %s", w.Code, w.Body.String())
+	}
+	if p.requests("get_live_streams") != 1 {
+		t.Error("the catalog was not fetched")
+	}
+	if logs.Len() == 0 {
+		t.Fatal("no log output captured")
+	}
+	if strings.Contains(logs.String(), password) || strings.Contains(w.Body.String(), password) {
+		t.Errorf("password leaked:\n%s", logs.String())
+	}
+}
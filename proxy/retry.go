@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides what to do after a failed upstream attempt.
+// resp is nil when the request itself failed with err. ctx is the context
+// the attempt ran under; its deadline is the retry budget.
+type RetryPolicy interface {
+	Decide(ctx context.Context, attempt int, resp *http.Response, err error) RetryDecision
+}
+
+// RetryDecision is the outcome of one RetryPolicy.Decide call
+type RetryDecision struct {
+	Retry  bool
+	Delay  time.Duration
+	Reason string
+}
+
+// attemptRecord describes one upstream attempt and what was decided after it
+type attemptRecord struct {
+	Attempt  int           `json:"attempt"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Decision string        `json:"decision"` // success, retry or give_up
+	Reason   string        `json:"reason,omitempty"`
+	Delay    time.Duration `json:"delay,omitempty"`
+}
+
+// backoffPolicy retries transient failures with exponential backoff and
+// full jitter, honouring Retry-After and never sleeping past the deadline
+type backoffPolicy struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	// retryStatus lists the statuses worth another attempt. Xtream panels
+	// answer 404 when they rate limit, so it is treated as transient.
+	retryStatus map[int]bool
+}
+
+func newBackoffPolicy(maxRetries int, baseDelay, maxDelay time.Duration) *backoffPolicy {
+	return &backoffPolicy{
+		maxRetries: maxRetries,
+		baseDelay:  baseDelay,
+		maxDelay:   maxDelay,
+		retryStatus: map[int]bool{
+			http.StatusNotFound:            true,
+			http.StatusRequestTimeout:      true,
+			http.StatusTooEarly:            true,
+			http.StatusTooManyRequests:     true,
+			http.StatusInternalServerError: true,
+			http.StatusBadGateway:          true,
+			http.StatusServiceUnavailable:  true,
+			http.StatusGatewayTimeout:      true,
+		},
+	}
+}
+
+func (p *backoffPolicy) Decide(ctx context.Context, attempt int, resp *http.Response, err error) RetryDecision {
+	var retryAfter time.Duration
+	if resp != nil {
+		if !p.retryStatus[resp.StatusCode] {
+			return RetryDecision{Reason: "status " + strconv.Itoa(resp.StatusCode) + " is not retryable"}
+		}
+		retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	} else if retryable, reason := classifyError(ctx, err); !retryable {
+		return RetryDecision{Reason: reason}
+	}
+
+	if attempt >= p.maxRetries {
+		return RetryDecision{Reason: "retries exhausted"}
+	}
+
+	// Full jitter: anywhere between zero and the exponential ceiling
+	ceiling := p.baseDelay << attempt
+	if ceiling > p.maxDelay || ceiling <= 0 {
+		ceiling = p.maxDelay
+	}
+	delay := time.Duration(rand.Int64N(int64(ceiling) + 1))
+	reason := "backoff"
+	if retryAfter > delay {
+		delay = retryAfter
+		reason = "retry-after"
+	}
+
+	if delay >= remainingBudget(ctx) {
+		return RetryDecision{Reason: "retry budget exhausted by deadline"}
+	}
+	return RetryDecision{Retry: true, Delay: delay, Reason: reason}
+}
+
+// classifyError tells transient network failures from permanent ones.
+// Whether the budget is spent is read from ctx, the attempt's context: the
+// client's per-attempt timeout also wraps context.DeadlineExceeded, and is
+// worth retrying while the budget lasts.
+func classifyError(ctx context.Context, err error) (retryable bool, reason string) {
+	var dnsErr *net.DNSError
+	var certErr *x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled), errors.Is(err, context.Canceled):
+		return false, "request cancelled"
+	case ctx.Err() != nil:
+		return false, "deadline exceeded"
+	case errors.Is(err, errAddressBlocked):
+		return false, "address blocked"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return false, "host not found"
+	case errors.As(err, &certErr), errors.As(err, &hostErr):
+		return false, "TLS certificate rejected"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return true, "network timeout"
+	default:
+		// Resets, refused connections and EOFs are usually transient
+		return true, "network error"
+	}
+}
+
+// parseRetryAfter reads delay-seconds or an HTTP-date; zero when absent
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// remainingBudget is the time left before ctx's deadline
+func remainingBudget(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline)
+	}
+	return math.MaxInt64
+}
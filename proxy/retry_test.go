@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	live := context.Background()
+	cancelled, cancel := context.WithCancel(live)
+	cancel()
+	expired, cancel := context.WithDeadline(live, time.Now().Add(-time.Second))
+	defer cancel()
+
+	// http.Client reports its own Timeout with the same error as a context deadline
+	clientTimeout := &url.Error{Op: "Get", URL: "http://provider.example", Err: context.DeadlineExceeded}
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		err       error
+		retryable bool
+		reason    string
+	}{
+		{"client timeout within budget", live, clientTimeout, true, "network timeout"},
+		{"client timeout past the deadline", expired, clientTimeout, false, "deadline exceeded"},
+		{"cancelled", cancelled, &url.Error{Op: "Get", URL: "http://provider.example", Err: context.Canceled}, false, "request cancelled"},
+		{"blocked", live, fmt.Errorf("dial: %w", errAddressBlocked), false, "address blocked"},
+		{"no such host", live, &net.DNSError{Err: "no such host", Name: "provider.example", IsNotFound: true}, false, "host not found"},
+		{"unknown authority", live, &x509.UnknownAuthorityError{}, false, "TLS certificate rejected"},
+		{"connection refused", live, &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true, "network error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retryable, reason := classifyError(tt.ctx, tt.err)
+			if retryable != tt.retryable || reason != tt.reason {
+				t.Errorf("classifyError = %v %q, want %v %q", retryable, reason, tt.retryable, tt.reason)
+			}
+		})
+	}
+}
+
+// slowOnce answers the first request after delay and the others at once
+func slowOnce(delay time.Duration) http.HandlerFunc {
+	var calls atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte("[]"))
+	}
+}
+
+func TestPerAttemptTimeoutIsRetried(t *testing.T) {
+	upstream, allow := newUpstream(t, slowOnce(2*time.Second))
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.UpstreamTimeout = 100 * time.Millisecond
+		c.RetryDelay = time.Millisecond
+		c.RetryMaxDelay = time.Millisecond
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	attempts, err := s.fetchDecode(ctx, upstream.URL+"/player_api.php?action=get_live_streams", discard)
+	if err != nil {
+		t.Fatalf("fetch = %v, want success on the retry (attempts %+v)", err, attempts)
+	}
+	if len(attempts) != 2 || attempts[0].Decision != "retry" || attempts[1].Decision != "success" {
+		t.Errorf("attempts = %+v, want a retried timeout then a success", attempts)
+	}
+}
+
+func TestBudgetDeadlineIsNotRetried(t *testing.T) {
+	upstream, allow := newUpstream(t, slowOnce(2*time.Second))
+	s := newTestServer(t, func(c *Config) {
+		allow(c)
+		c.RetryDelay = time.Millisecond
+		c.RetryMaxDelay = time.Millisecond
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	attempts, err := s.fetchDecode(ctx, upstream.URL+"/player_api.php?action=get_live_streams", discard)
+	if err == nil {
+		t.Fatal("fetch succeeded past its deadline")
+	}
+	if len(attempts) != 1 || attempts[0].Decision != "give_up" || attempts[0].Reason != "deadline exceeded" {
+		t.Errorf("attempts = %+v, want one attempt given up on the deadline", attempts)
+	}
+}
@@ -0,0 +1,256 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// proxyProcess is the proxy running as a child process, on its own port
+type proxyProcess struct {
+	cmd    *exec.Cmd
+	addr   string
+	config string
+	logs   *bytes.Buffer
+	exited chan error
+}
+
+// startProxy re-execs the test binary as the proxy with config, a YAML
+// document formatted with the listen address, and waits until it serves
+func startProxy(t *testing.T, config string) *proxyProcess {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := &proxyProcess{addr: addr, config: filepath.Join(t.TempDir(), "proxy.yaml"), logs: new(bytes.Buffer), exited: make(chan error, 1)}
+	p.writeConfig(t, config)
+	p.cmd = exec.Command(os.Args[0])
+	p.cmd.Env = append(os.Environ(), "PROXY_TEST_MAIN=1", "PROXY_CONFIG_FILE="+p.config)
+	p.cmd.Stderr = p.logs
+	if err := p.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { p.exited <- p.cmd.Wait() }()
+	t.Cleanup(func() {
+		p.cmd.Process.Kill()
+		if t.Failed() {
+			t.Logf("proxy output:\n%s", p.logs)
+		}
+	})
+
+	p.waitFor(t, "the proxy to listen", func() bool {
+		resp, err := http.Get(p.url("/health"))
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return p
+}
+
+func (p *proxyProcess) writeConfig(t *testing.T, config string) {
+	t.Helper()
+	if err := os.WriteFile(p.config, []byte(fmt.Sprintf(config, p.addr)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *proxyProcess) url(path string) string { return "http://" + p.addr + path }
+
+func (p *proxyProcess) signal(t *testing.T, sig os.Signal) {
+	t.Helper()
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond for up to five seconds
+func (p *proxyProcess) waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// ready fetches /ready and returns its status code and body
+func (p *proxyProcess) ready(t *testing.T) (int, map[string]any) {
+	t.Helper()
+	resp, err := http.Get(p.url("/ready"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+// xtreamPanel serves a tiny catalog; get_live_streams blocks while hold
+// is set, after signalling on entered
+func xtreamPanel(t *testing.T, hold *atomic.Bool, entered chan<- struct{}, release <-chan struct{}) string {
+	upstream, _ := newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("action") {
+		case "":
+			io.WriteString(w, `{"user_info":{"auth":1,"status":"Active"}}`)
+		case "get_live_streams":
+			if hold.Load() {
+				entered <- struct{}{}
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+			}
+			io.WriteString(w, `[{"name":"News","category_id":"1","stream_id":1}]`)
+		case "get_live_categories":
+			io.WriteString(w, `[{"category_id":"1","category_name":"General"}]`)
+		default:
+			io.WriteString(w, `[]`)
+		}
+	})
+	return upstream.URL
+}
+
+func getCatalog(p *proxyProcess, baseURL string) (*http.Response, error) {
+	req, _ := http.NewRequest(http.MethodGet, p.url("/get"), nil)
+	req.Header.Set(headerBaseURL, baseURL)
+	req.Header.Set(headerUsername, "alice")
+	req.Header.Set(headerPassword, "secret")
+	return http.DefaultClient.Do(req)
+}
+
+const signalTestConfig = `
+server:
+  addr: "%s"
+  drain_delay: 1s
+  shutdown_timeout: 10s
+ready:
+  max_saturation: %s
+egress:
+  allowlist: [127.0.0.1/32]
+log:
+  level: warn
+`
+
+func TestSIGHUPReloadsConfig(t *testing.T) {
+	p := startProxy(t, fmt.Sprintf(signalTestConfig, "%s", "0.9"))
+	if _, body := p.ready(t); capacityField(body, "maxSaturation") != 0.9 {
+		t.Fatalf("maxSaturation before reload = %v, want 0.9", capacityField(body, "maxSaturation"))
+	}
+
+	p.writeConfig(t, fmt.Sprintf(signalTestConfig, "%s", "0.5"))
+	p.signal(t, syscall.SIGHUP)
+	p.waitFor(t, "the reloaded max_saturation", func() bool {
+		_, body := p.ready(t)
+		return capacityField(body, "maxSaturation") == 0.5
+	})
+
+	// A broken file is ignored and the running settings kept
+	p.writeConfig(t, "server: [%s")
+	p.signal(t, syscall.SIGHUP)
+	time.Sleep(200 * time.Millisecond)
+	if _, body := p.ready(t); capacityField(body, "maxSaturation") != 0.5 {
+		t.Errorf("maxSaturation after a bad reload = %v, want 0.5 kept", capacityField(body, "maxSaturation"))
+	}
+}
+
+func TestSIGTERMDrainsInflightRequests(t *testing.T) {
+	var hold atomic.Bool
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	baseURL := xtreamPanel(t, &hold, entered, release)
+	p := startProxy(t, fmt.Sprintf(signalTestConfig, "%s", "0.9"))
+
+	hold.Store(true)
+	inflight := make(chan *http.Response, 1)
+	go func() {
+		resp, err := getCatalog(p, baseURL)
+		if err != nil {
+			t.Errorf("in-flight /get: %v", err)
+			close(inflight)
+			return
+		}
+		inflight <- resp
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the /get never reached the upstream")
+	}
+
+	p.signal(t, syscall.SIGTERM)
+
+	// During drain_delay /ready fails and new work is turned away
+	p.waitFor(t, "/ready to report draining", func() bool {
+		code, _ := p.ready(t)
+		return code == http.StatusServiceUnavailable
+	})
+	resp, err := getCatalog(p, baseURL)
+	if err != nil {
+		t.Fatalf("new /get while draining: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("new /get while draining = %d, want 503", resp.StatusCode)
+	}
+
+	// Then the listener closes while the first request is still running
+	p.waitFor(t, "the listener to close", func() bool {
+		conn, err := net.Dial("tcp", p.addr)
+		if err != nil {
+			return true
+		}
+		conn.Close()
+		return false
+	})
+
+	close(release)
+	select {
+	case resp, ok := <-inflight:
+		if !ok {
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("in-flight /get = %d %s, want 200", resp.StatusCode, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the in-flight /get never completed")
+	}
+
+	select {
+	case err := <-p.exited:
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			t.Errorf("proxy exited with %d, want 0", exit.ExitCode())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy did not exit after draining")
+	}
+}
+
+func capacityField(body map[string]any, key string) any {
+	components, _ := body["components"].(map[string]any)
+	capacity, _ := components["capacity"].(map[string]any)
+	return capacity[key]
+}
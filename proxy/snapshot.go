@@ -0,0 +1,263 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"hash/fnv"
+	"slices"
+	"sync"
+	"time"
+)
+
+// CatalogDelta lists what changed in a catalog since an earlier snapshot
+type CatalogDelta struct {
+	Delta      bool           `json:"delta"`
+	Since      string         `json:"since"`
+	SnapshotID string         `json:"snapshotId"`
+	UserInfo   XtreamUserInfo `json:"userInfo"`
+	Live       SectionDelta   `json:"live"`
+	VOD        SectionDelta   `json:"vod"`
+	Series     SectionDelta   `json:"series"`
+	Statistics Statistics     `json:"statistics"`
+	FetchedAt  int64          `json:"fetchedAt"`
+}
+
+// SectionDelta holds the changes for one of live, VOD or series.
+// Streams are keyed by stream_id, or series_id for series.
+type SectionDelta struct {
+	AddedCategories    []CategoryInfo `json:"addedCategories"`
+	ModifiedCategories []CategoryInfo `json:"modifiedCategories"`
+	RemovedCategories  []string       `json:"removedCategories"`
+	AddedStreams       []StreamInfo   `json:"addedStreams"`
+	ModifiedStreams    []StreamInfo   `json:"modifiedStreams"`
+	RemovedStreams     []string       `json:"removedStreams"`
+}
+
+// snapshotIndex is the compact form of a catalog kept for delta sync:
+// one content hash per category and stream instead of the items themselves
+type snapshotIndex struct {
+	id         string
+	recordedAt time.Time
+	sections   []sectionIndex // parallel to catalogSections
+}
+
+type sectionIndex struct {
+	categories map[string]uint64
+	streams    map[string]uint64
+}
+
+// snapshotStore keeps the most recent snapshots per provider account
+type snapshotStore struct {
+	mu          sync.Mutex
+	retention   int
+	ttl         time.Duration
+	maxAccounts int
+	accounts    map[string]*list.Element
+	lru         *list.List // front is most recently used
+}
+
+type accountSnapshots struct {
+	key       string
+	snapshots []*snapshotIndex // oldest first
+}
+
+func newSnapshotStore(retention int, ttl time.Duration, maxAccounts int) *snapshotStore {
+	return &snapshotStore{
+		retention:   retention,
+		ttl:         ttl,
+		maxAccounts: maxAccounts,
+		accounts:    make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// record makes data the latest snapshot for key and returns its index.
+// Indexing only happens when the content differs from the latest snapshot.
+func (s *snapshotStore) record(key string, data *NormalizedData) *snapshotIndex {
+	now := time.Now()
+
+	s.mu.Lock()
+	if el, ok := s.accounts[key]; ok {
+		acct := el.Value.(*accountSnapshots)
+		if n := len(acct.snapshots); n > 0 && acct.snapshots[n-1].id == data.SnapshotID {
+			latest := acct.snapshots[n-1]
+			latest.recordedAt = now
+			s.lru.MoveToFront(el)
+			s.mu.Unlock()
+			return latest
+		}
+	}
+	s.mu.Unlock()
+
+	// Hashing every item is the expensive part, keep it outside the lock
+	idx := indexCatalog(data)
+	idx.recordedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.accounts[key]
+	if !ok {
+		el = s.lru.PushFront(&accountSnapshots{key: key})
+		s.accounts[key] = el
+	}
+	s.lru.MoveToFront(el)
+
+	acct := el.Value.(*accountSnapshots)
+	acct.snapshots = append(s.live(acct.snapshots, now), idx)
+	if extra := len(acct.snapshots) - s.retention; extra > 0 {
+		acct.snapshots = acct.snapshots[extra:]
+	}
+
+	for s.lru.Len() > s.maxAccounts {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.accounts, oldest.Value.(*accountSnapshots).key)
+	}
+	return idx
+}
+
+// lookup returns an unexpired snapshot of key by id
+func (s *snapshotStore) lookup(key, id string) (*snapshotIndex, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.accounts[key]
+	if !ok {
+		return nil, false
+	}
+	acct := el.Value.(*accountSnapshots)
+	acct.snapshots = s.live(acct.snapshots, time.Now())
+	for _, snap := range acct.snapshots {
+		if snap.id == id {
+			return snap, true
+		}
+	}
+	return nil, false
+}
+
+// live returns the snapshots that were last current at most ttl ago, in a
+// new slice: the caller's may still be stored
+func (s *snapshotStore) live(snapshots []*snapshotIndex, now time.Time) []*snapshotIndex {
+	kept := make([]*snapshotIndex, 0, len(snapshots))
+	for _, snap := range snapshots {
+		if now.Sub(snap.recordedAt) <= s.ttl {
+			kept = append(kept, snap)
+		}
+	}
+	return kept
+}
+
+// indexCatalog hashes every category and stream of a catalog
+func indexCatalog(data *NormalizedData) *snapshotIndex {
+	idx := &snapshotIndex{id: data.SnapshotID, sections: make([]sectionIndex, len(catalogSections))}
+
+	h := fnv.New64a()
+	encoder := json.NewEncoder(h)
+	hashOf := func(v any) uint64 {
+		h.Reset()
+		encoder.Encode(v)
+		return h.Sum64()
+	}
+
+	for i, sec := range catalogSections {
+		categories, grouped := data.sectionFields(sec)
+		si := sectionIndex{
+			categories: make(map[string]uint64, len(*categories)),
+			streams:    make(map[string]uint64),
+		}
+		for _, cat := range *categories {
+			si.categories[cat.CategoryID] = hashOf(cat)
+		}
+		for _, group := range *grouped {
+			for j := range group.Streams {
+				si.streams[streamKey(sec, &group.Streams[j])] = hashOf(&group.Streams[j])
+			}
+		}
+		idx.sections[i] = si
+	}
+	return idx
+}
+
+// streamKey identifies a stream within its section
+func streamKey(sec catalogSection, stream *StreamInfo) string {
+	id := stream.StreamID
+	if sec.streamsKey == "series" {
+		id = stream.SeriesID
+	}
+	if id == nil {
+		// Without an id the name is the best identity we have
+		return "name:" + stream.Name
+	}
+	return looseString(id)
+}
+
+// buildDelta compares the current catalog against an earlier snapshot
+func buildDelta(base, current *snapshotIndex, data *NormalizedData) *CatalogDelta {
+	delta := &CatalogDelta{
+		Delta:      true,
+		Since:      base.id,
+		SnapshotID: current.id,
+		UserInfo:   data.UserInfo,
+		Statistics: data.Statistics,
+		FetchedAt:  data.FetchedAt,
+	}
+
+	for i, sec := range catalogSections {
+		categories, grouped := data.sectionFields(sec)
+		was, now := base.sections[i], current.sections[i]
+		out := delta.sectionDelta(sec)
+		*out = SectionDelta{
+			AddedCategories:    []CategoryInfo{},
+			ModifiedCategories: []CategoryInfo{},
+			RemovedCategories:  []string{},
+			AddedStreams:       []StreamInfo{},
+			ModifiedStreams:    []StreamInfo{},
+			RemovedStreams:     []string{},
+		}
+
+		for _, cat := range *categories {
+			if old, ok := was.categories[cat.CategoryID]; !ok {
+				out.AddedCategories = append(out.AddedCategories, cat)
+			} else if old != now.categories[cat.CategoryID] {
+				out.ModifiedCategories = append(out.ModifiedCategories, cat)
+			}
+		}
+		for id := range was.categories {
+			if _, ok := now.categories[id]; !ok {
+				out.RemovedCategories = append(out.RemovedCategories, id)
+			}
+		}
+		slices.Sort(out.RemovedCategories)
+
+		for _, group := range *grouped {
+			for j := range group.Streams {
+				key := streamKey(sec, &group.Streams[j])
+				if old, ok := was.streams[key]; !ok {
+					out.AddedStreams = append(out.AddedStreams, group.Streams[j])
+				} else if old != now.streams[key] {
+					out.ModifiedStreams = append(out.ModifiedStreams, group.Streams[j])
+				}
+			}
+		}
+		for key := range was.streams {
+			if _, ok := now.streams[key]; !ok {
+				out.RemovedStreams = append(out.RemovedStreams, key)
+			}
+		}
+		slices.Sort(out.RemovedStreams)
+	}
+	return delta
+}
+
+// sectionDelta returns the delta for a section, like NormalizedData.sectionFields
+func (d *CatalogDelta) sectionDelta(sec catalogSection) *SectionDelta {
+	switch sec.categoriesKey {
+	case "live_categories":
+		return &d.Live
+	case "vod_categories":
+		return &d.VOD
+	default:
+		return &d.Series
+	}
+}
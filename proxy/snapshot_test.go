@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDelta(t *testing.T) {
+	base := &NormalizedData{
+		SnapshotID: "base",
+		Categories: Categories{
+			Live:   []CategoryInfo{{"1", "News"}, {"2", "Sports"}},
+			VOD:    []CategoryInfo{{"1", "Movies"}},
+			Series: []CategoryInfo{{"1", "Drama"}},
+		},
+		CategorizedStreams: CategorizedStreams{
+			Live: []CategoryWithStreams{
+				{CategoryID: "1", Streams: []StreamInfo{{StreamID: 100, Name: "A"}, {StreamID: 101, Name: "B"}}},
+				{CategoryID: "2", Streams: []StreamInfo{{StreamID: 102, Name: "C"}}},
+			},
+			VOD: []CategoryWithStreams{
+				{CategoryID: "1", Streams: []StreamInfo{{StreamID: 101, Name: "Film"}}},
+			},
+			Series: []CategoryWithStreams{
+				{CategoryID: "1", Streams: []StreamInfo{{SeriesID: 7, Name: "S7"}, {SeriesID: 8, Name: "S8"}}},
+			},
+		},
+	}
+	current := &NormalizedData{
+		SnapshotID: "current",
+		Categories: Categories{
+			Live:   []CategoryInfo{{"1", "Headlines"}, {"3", "Kids"}},
+			VOD:    []CategoryInfo{{"1", "Movies"}},
+			Series: []CategoryInfo{{"1", "Drama"}},
+		},
+		CategorizedStreams: CategorizedStreams{
+			Live: []CategoryWithStreams{
+				// the live stream 101 changes, the film with the same id does not
+				{CategoryID: "1", Streams: []StreamInfo{{StreamID: 100, Name: "A"}, {StreamID: 101, Name: "B2"}}},
+				{CategoryID: "3", Streams: []StreamInfo{{StreamID: 103, Name: "D"}}},
+			},
+			VOD: []CategoryWithStreams{
+				{CategoryID: "1", Streams: []StreamInfo{{StreamID: 101, Name: "Film"}}},
+			},
+			Series: []CategoryWithStreams{
+				{CategoryID: "1", Streams: []StreamInfo{{SeriesID: 7, Name: "S7", Rating: "5"}, {SeriesID: 9, Name: "S9"}}},
+			},
+		},
+	}
+
+	delta := buildDelta(indexCatalog(base), indexCatalog(current), current)
+	if !delta.Delta || delta.Since != "base" || delta.SnapshotID != "current" {
+		t.Fatalf("delta header = %v %q %q", delta.Delta, delta.Since, delta.SnapshotID)
+	}
+
+	tests := []struct {
+		name    string
+		section SectionDelta
+		series  bool
+		want    [6][]string // added, modified, removed categories; then streams
+	}{
+		{"live", delta.Live, false, [6][]string{{"3"}, {"1"}, {"2"}, {"103"}, {"101"}, {"102"}}},
+		{"vod", delta.VOD, false, [6][]string{}},
+		{"series", delta.Series, true, [6][]string{{}, {}, {}, {"9"}, {"7"}, {"8"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := [6][]string{
+				categoryIDs(tt.section.AddedCategories),
+				categoryIDs(tt.section.ModifiedCategories),
+				tt.section.RemovedCategories,
+				streamIDs(tt.section.AddedStreams, tt.series),
+				streamIDs(tt.section.ModifiedStreams, tt.series),
+				tt.section.RemovedStreams,
+			}
+			for i := range got {
+				if len(got[i]) != 0 || len(tt.want[i]) != 0 {
+					if !slices.Equal(got[i], tt.want[i]) {
+						t.Errorf("changes = %q, want %q", got, tt.want)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotLookupDropsExpired(t *testing.T) {
+	store := newSnapshotStore(3, time.Hour, 10)
+	first := store.record("acct", &NormalizedData{SnapshotID: "a"})
+	store.record("acct", &NormalizedData{SnapshotID: "b"})
+	first.recordedAt = time.Now().Add(-2 * time.Hour)
+
+	if _, ok := store.lookup("acct", "a"); ok {
+		t.Error("an expired snapshot was found")
+	}
+	for range 2 {
+		if _, ok := store.lookup("acct", "b"); !ok {
+			t.Error("the live snapshot was not found")
+		}
+	}
+	if got := storedIDs(store, "acct"); !slices.Equal(got, []string{"b"}) {
+		t.Fatalf("stored after lookup = %q, want [b]", got)
+	}
+
+	store.record("acct", &NormalizedData{SnapshotID: "c"})
+	store.record("acct", &NormalizedData{SnapshotID: "d"})
+	store.record("acct", &NormalizedData{SnapshotID: "e"})
+	if got := storedIDs(store, "acct"); !slices.Equal(got, []string{"c", "d", "e"}) {
+		t.Errorf("stored = %q, want [c d e]", got)
+	}
+	for _, id := range []string{"c", "d", "e"} {
+		if _, ok := store.lookup("acct", id); !ok {
+			t.Errorf("snapshot %s was not found", id)
+		}
+	}
+}
+
+func TestSinceFallsBackToFullCatalog(t *testing.T) {
+	p, allow := newPanel(t)
+	p.set("get_live_categories", `[{"category_id":"1","category_name":"News"}]`)
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1}]`)
+	s := newTestServer(t, allow)
+
+	first := serve(s, catalogRequest(p.URL, ""))
+	if first.Code != http.StatusOK {
+		t.Fatalf("first /get = %d: %s", first.Code, first.Body)
+	}
+	base := first.Header().Get("X-Snapshot-ID")
+
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1},{"name":"B","category_id":"1","stream_id":2}]`)
+
+	// While the base is kept the answer is a delta
+	w := serve(s, catalogRequest(p.URL, "cache=bypass&since="+base))
+	var delta struct {
+		Data CatalogDelta `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &delta); err != nil {
+		t.Fatal(err)
+	}
+	if !delta.Data.Delta || delta.Data.Since != base {
+		t.Fatalf("since a kept snapshot = %s", w.Body)
+	}
+	if got := streamIDs(delta.Data.Live.AddedStreams, false); !slices.Equal(got, []string{"2"}) {
+		t.Errorf("added live streams = %q, want [2]", got)
+	}
+
+	// Once it expired the full catalog comes back, saying why
+	s.snapshots.mu.Lock()
+	for _, el := range s.snapshots.accounts {
+		for _, snap := range el.Value.(*accountSnapshots).snapshots {
+			snap.recordedAt = time.Now().Add(-2 * s.snapshots.ttl)
+		}
+	}
+	s.snapshots.mu.Unlock()
+
+	w = serve(s, catalogRequest(p.URL, "cache=bypass&since="+base))
+	if w.Code != http.StatusOK {
+		t.Fatalf("since an expired snapshot = %d: %s", w.Code, w.Body)
+	}
+	var full struct {
+		Message string         `json:"message"`
+		Data    NormalizedData `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &full); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(full.Message, "no longer available") {
+		t.Errorf("message = %q", full.Message)
+	}
+	if full.Data.Statistics.TotalLive != 2 || full.Data.SnapshotID == "" {
+		t.Errorf("since an expired snapshot did not return the full catalog: %s", w.Body)
+	}
+}
+
+func categoryIDs(categories []CategoryInfo) []string {
+	ids := make([]string, len(categories))
+	for i, cat := range categories {
+		ids[i] = cat.CategoryID
+	}
+	return ids
+}
+
+func streamIDs(streams []StreamInfo, series bool) []string {
+	ids := make([]string, len(streams))
+	for i, stream := range streams {
+		if series {
+			ids[i] = looseString(stream.SeriesID)
+		} else {
+			ids[i] = looseString(stream.StreamID)
+		}
+	}
+	return ids
+}
+
+func storedIDs(store *snapshotStore, key string) []string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var ids []string
+	for _, snap := range store.accounts[key].Value.(*accountSnapshots).snapshots {
+		ids = append(ids, snap.id)
+	}
+	return ids
+}
+
+func TestDeltaHasItsOwnETag(t *testing.T) {
+	p, allow := newPanel(t)
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1}]`)
+	s := newTestServer(t, allow)
+
+	first := serve(s, catalogRequest(p.URL, ""))
+	base, full := first.Header().Get("X-Snapshot-ID"), first.Header().Get("ETag")
+	p.set("get_live_streams", `[{"name":"A","category_id":"1","stream_id":1},{"name":"B","category_id":"1","stream_id":2}]`)
+
+	r := catalogRequest(p.URL, "cache=bypass&since="+base)
+	r.Header.Set("If-None-Match", full)
+	w := serve(s, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"delta":true`) {
+		t.Fatalf("delta with the full catalog's tag = %d: %s", w.Code, w.Body)
+	}
+	tag := w.Header().Get("ETag")
+	if tag == "" || tag == full {
+		t.Fatalf("delta ETag = %q, full catalog ETag = %q", tag, full)
+	}
+
+	r = catalogRequest(p.URL, "since="+base)
+	r.Header.Set("If-None-Match", tag)
+	if w := serve(s, r); w.Code != http.StatusNotModified {
+		t.Errorf("delta with its own tag = %d, want 304", w.Code)
+	}
+	r = catalogRequest(p.URL, "")
+	r.Header.Set("If-None-Match", tag)
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Errorf("full catalog with the delta's tag = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// defaultBlockedRanges are the loopback, private, link-local and other
+// special-purpose ranges a user-supplied base_url must never reach
+var defaultBlockedRanges = []string{
+	"0.0.0.0/8",       // "this" network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local, including cloud metadata endpoints
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved, including broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // NAT64, can embed private IPv4
+	"64:ff9b:1::/48",  // local-use NAT64
+	"100::/64",        // discard
+	"2001::/23",       // IETF protocol assignments
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, can embed private IPv4
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+}
+
+// EgressConfig controls which addresses upstream connections may reach.
+// Entries are CIDR prefixes or single IPs.
+type EgressConfig struct {
+	Blocked []string // ranges refused at dial time, by default defaultBlockedRanges
+	Allowed []string // exceptions to Blocked, e.g. a provider on a private network
+}
+
+// errAddressBlocked is wrapped by every dial refused by the egress policy
+var errAddressBlocked = errors.New("address blocked")
+
+// blockedAddressError reports the resolved address a dial was refused for
+type blockedAddressError struct {
+	addr netip.Addr
+}
+
+func (e *blockedAddressError) Error() string {
+	return fmt.Sprintf("upstream address %s is not allowed", e.addr)
+}
+
+func (e *blockedAddressError) Unwrap() error { return errAddressBlocked }
+
+// egressPolicy decides whether an upstream IP may be dialed
+type egressPolicy struct {
+	blocked []netip.Prefix
+	allowed []netip.Prefix
+}
+
+func newEgressPolicy(config EgressConfig) (*egressPolicy, error) {
+	p := &egressPolicy{}
+	var err error
+	if p.blocked, err = parsePrefixes(config.Blocked); err != nil {
+		return nil, fmt.Errorf("invalid egress blocklist: %w", err)
+	}
+	if p.allowed, err = parsePrefixes(config.Allowed); err != nil {
+		return nil, fmt.Errorf("invalid egress allowlist: %w", err)
+	}
+	return p, nil
+}
+
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits reports whether addr may be dialed. IPv4-mapped IPv6 addresses
+// are checked as IPv4 so ::ffff:127.0.0.1 cannot slip through.
+func (p *egressPolicy) permits(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	for _, prefix := range p.blocked {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// control is installed as net.Dialer.Control. It runs after name resolution,
+// on the exact IP about to be connected to, so a hostname that resolves (or
+// later re-resolves) to a blocked address is refused too.
+func (p *egressPolicy) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return &blockedAddressError{}
+	}
+	if !p.permits(addrPort.Addr()) {
+		return &blockedAddressError{addr: addrPort.Addr()}
+	}
+	return nil
+}
+
+// writeAddressBlocked answers a request whose base_url resolved to a
+// blocked address
+func (s *Server) writeAddressBlocked(w http.ResponseWriter, err error) {
+	var blockedErr *blockedAddressError
+	message := "The provider address is not allowed"
+	if errors.As(err, &blockedErr) && blockedErr.addr.IsValid() {
+		message = blockedErr.Error()
+	}
+	s.writeJSON(w, http.StatusForbidden, ProxyResponse{
+		Success: false,
+		Code:    "UPSTREAM_ADDRESS_BLOCKED",
+		Message: message,
+		Data:    nil,
+	})
+}
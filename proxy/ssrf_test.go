@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	defaults, err := newEgressPolicy(EgressConfig{Blocked: defaultBlockedRanges})
+	if err != nil {
+		t.Fatal(err)
+	}
+	override, err := newEgressPolicy(EgressConfig{Blocked: defaultBlockedRanges, Allowed: []string{"10.0.0.5", "fd00:1::/64"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy *egressPolicy
+		addr   string
+		want   bool
+	}{
+		{defaults, "127.0.0.1", false},
+		{defaults, "127.8.9.10", false},
+		{defaults, "::1", false},
+		{defaults, "169.254.169.254", false}, // cloud metadata
+		{defaults, "fe80::1", false},
+		{defaults, "10.1.2.3", false},
+		{defaults, "172.16.0.1", false},
+		{defaults, "172.31.255.255", false},
+		{defaults, "192.168.1.1", false},
+		{defaults, "100.64.0.1", false},
+		{defaults, "fd00::1", false},
+		{defaults, "0.0.0.0", false},
+		{defaults, "::", false},
+		{defaults, "::ffff:127.0.0.1", false}, // IPv4-mapped, checked as IPv4
+		{defaults, "::ffff:169.254.169.254", false},
+		{defaults, "::ffff:10.0.0.1", false},
+		{defaults, "64:ff9b::a00:1", false}, // NAT64 of 10.0.0.1
+		{defaults, "172.32.0.1", true},
+		{defaults, "8.8.8.8", true},
+		{defaults, "::ffff:8.8.8.8", true},
+		{defaults, "2606:4700:4700::1111", true},
+		{override, "10.0.0.5", true},
+		{override, "::ffff:10.0.0.5", true},
+		{override, "10.0.0.6", false},
+		{override, "fd00:1::8", true},
+		{override, "fd00:2::8", false},
+		{override, "127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		policy := "default"
+		if tt.policy == override {
+			policy = "override"
+		}
+		if got := tt.policy.permits(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s policy permits(%s) = %v, want %v", policy, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEgressControl(t *testing.T) {
+	policy, err := newEgressPolicy(EgressConfig{Blocked: defaultBlockedRanges})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range []string{"127.0.0.1:80", "[::ffff:127.0.0.1]:80", "[::1]:443", "169.254.169.254:80", "garbage"} {
+		if err := policy.control("tcp", address, nil); !errors.Is(err, errAddressBlocked) {
+			t.Errorf("control(%s) = %v, want %v", address, err, errAddressBlocked)
+		}
+	}
+	if err := policy.control("tcp", "93.184.216.34:80", nil); err != nil {
+		t.Errorf("control of a public address = %v", err)
+	}
+	if _, err := newEgressPolicy(EgressConfig{Blocked: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("an invalid blocklist was accepted")
+	}
+}
+
+func TestBlockedProviderAddress(t *testing.T) {
+	p, allow := newPanel(t)
+	blocked := newTestServer(t, nil)
+	allowed := newTestServer(t, allow)
+	port := p.URL[strings.LastIndex(p.URL, ":"):]
+
+	// Both a literal loopback IP and a name resolving to one are refused
+	// before anything is sent
+	for _, baseURL := range []string{p.URL, "http://localhost" + port} {
+		w := serve(blocked, catalogRequest(baseURL, ""))
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"UPSTREAM_ADDRESS_BLOCKED"`) {
+			t.Errorf("/get of %s = %d: %s", baseURL, w.Code, w.Body)
+		}
+	}
+	if n := p.requests(""); n != 0 {
+		t.Errorf("the blocked panel was reached %d times", n)
+	}
+
+	// The allowlist lets a deliberately private provider through
+	if w := serve(allowed, catalogRequest(p.URL, "")); w.Code != http.StatusOK {
+		t.Errorf("/get of an allowed address = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are recorded with the OpenTelemetry SDK and batched to stdout or to
+// a collector over OTLP/HTTP. W3C trace context links them to the caller's
+// trace and to the API's.
+
+const (
+	tracingNone   = "none"
+	tracingStdout = "stdout"
+	tracingOTLP   = "otlp"
+)
+
+// tracerName is the instrumentation scope of every span
+const tracerName = "syncstream-proxy"
+
+// maxQueuedSpans bounds the export queue; spans beyond it are dropped
+// rather than slowing requests down
+const maxQueuedSpans = 4096
+
+// TracingConfig selects where spans go
+type TracingConfig struct {
+	Exporter    string  // none, stdout or otlp
+	Endpoint    string  // OTLP/HTTP traces endpoint
+	ServiceName string  // service.name resource attribute
+	SampleRatio float64 // share of new traces recorded; incoming sampled traces always are
+}
+
+// traceContext reads and writes the traceparent and tracestate headers
+var traceContext = propagation.TraceContext{}
+
+// newTracerProvider returns nil when tracing is off
+func newTracerProvider(config TracingConfig) (*sdktrace.TracerProvider, error) {
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch config.Exporter {
+	case tracingStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case tracingOTLP:
+		exporter, err = otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(config.Endpoint))
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing exporter: %w", err)
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Span export failed", "error", err.Error())
+	}))
+	return tracerProvider(config, sdktrace.WithBatcher(exporter, sdktrace.WithMaxQueueSize(maxQueuedSpans))), nil
+}
+
+// tracerProvider records spans for config and hands them to export
+func tracerProvider(config TracingConfig, export sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		export,
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", config.ServiceName))),
+		// A caller's sampling decision wins; new traces are sampled by ratio
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+}
+
+// startSpan starts a child of the span in ctx. Without a recording parent
+// the returned span records nothing, so callers never check whether
+// tracing is on.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, parent
+	}
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+}
+
+// endSpan ends sp, marking it failed when err is not nil
+func endSpan(sp trace.Span, err error) {
+	if err != nil {
+		sp.SetStatus(codes.Error, redact(err.Error()))
+	}
+	sp.End()
+}
+
+// tracingMiddleware wraps each request in a server span named after the
+// mux pattern it matched, continuing the caller's trace when it sent a
+// traceparent, and tags its log lines with the trace id
+func (s *Server) tracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.traces == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := "other"
+		if _, pattern := mux.Handler(r); pattern != "" {
+			route = pattern
+		}
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, sp := s.traces.Tracer(tracerName).Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer))
+		if !sp.IsRecording() {
+			// Unsampled: children record nothing, but the API still gets
+			// the caller's trace context
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		ctx = withLogAttrs(ctx, "trace_id", sp.SpanContext().TraceID().String())
+		next.ServeHTTP(wrapped, r.WithContext(ctx))
+
+		sp.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", wrapped.statusCode),
+		)
+		var err error
+		if wrapped.statusCode >= http.StatusInternalServerError {
+			err = fmt.Errorf("HTTP %d", wrapped.statusCode)
+		}
+		endSpan(sp, err)
+	})
+}
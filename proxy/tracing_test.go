@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	callerTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	callerSpan  = "00f067aa0ba902b7"
+)
+
+// recordSpans makes s trace into memory at ratio, exporting every span as
+// soon as it ends
+func recordSpans(t *testing.T, s *Server, ratio float64) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	s.traces = tracerProvider(TracingConfig{ServiceName: "test", SampleRatio: ratio}, sdktrace.WithSyncer(exporter))
+	t.Cleanup(func() { s.traces.Shutdown(context.Background()) })
+	return exporter
+}
+
+// spanNamed returns the recorded span called name
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string) tracetest.SpanStub {
+	t.Helper()
+	i := slices.IndexFunc(spans, func(sp tracetest.SpanStub) bool { return sp.Name == name })
+	if i < 0 {
+		names := make([]string, len(spans))
+		for j, sp := range spans {
+			names[j] = sp.Name
+		}
+		t.Fatalf("no span %q among %q", name, names)
+	}
+	return spans[i]
+}
+
+func TestTracingContinuesCallerTrace(t *testing.T) {
+	p, allow := newPanel(t)
+	s := newTestServer(t, allow)
+	exporter := recordSpans(t, s, 0) // the caller's decision overrides the ratio
+
+	r := catalogRequest(p.URL, "")
+	r.Header.Set("traceparent", "00-"+callerTrace+"-"+callerSpan+"-01")
+	if w := serve(s, r); w.Code != http.StatusOK {
+		t.Fatalf("/get = %d", w.Code)
+	}
+
+	spans := exporter.GetSpans()
+	server := spanNamed(t, spans, "GET /get")
+	if got := server.SpanContext.TraceID().String(); got != callerTrace {
+		t.Errorf("trace id = %s, want the caller's", got)
+	}
+	if got := server.Parent.SpanID().String(); got != callerSpan || !server.Parent.IsRemote() {
+		t.Errorf("server span parent = %s, want the caller's span", got)
+	}
+	if server.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span kind = %v", server.SpanKind)
+	}
+	wantAttrs := []attribute.KeyValue{attribute.String("http.route", "/get"), attribute.Int("http.response.status_code", 200)}
+	for _, want := range wantAttrs {
+		if !slices.Contains(server.Attributes, want) {
+			t.Errorf("server span lacks %v: %v", want, server.Attributes)
+		}
+	}
+
+	// Work inside the request hangs off the server span
+	for _, name := range []string{"xtream.auth", "fetch live_streams", "normalize", "encode"} {
+		sp := spanNamed(t, spans, name)
+		if sp.SpanContext.TraceID() != server.SpanContext.TraceID() {
+			t.Errorf("%s is in another trace", name)
+		}
+	}
+	attempt := spanNamed(t, spans, "GET get_live_streams")
+	if attempt.SpanKind != trace.SpanKindClient || attempt.Parent.SpanID() != spanNamed(t, spans, "fetch live_streams").SpanContext.SpanID() {
+		t.Errorf("upstream attempt span = %v under %s", attempt.SpanKind, attempt.Parent.SpanID())
+	}
+	if got := attempt.Resource.Attributes(); !slices.Contains(got, attribute.String("service.name", "test")) {
+		t.Errorf("resource = %v, want service.name", got)
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	tests := []struct {
+		name        string
+		ratio       float64
+		traceparent string
+		recorded    bool
+	}{
+		{"new trace sampled", 1, "", true},
+		{"new trace dropped", 0, "", false},
+		{"caller did not sample", 1, "00-" + callerTrace + "-" + callerSpan + "-00", false},
+		{"malformed traceparent starts a new trace", 1, "00-zz-" + callerSpan + "-01", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := recordSpans(t, s, tt.ratio)
+			r := httptest.NewRequest(http.MethodGet, "/health", nil)
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			serve(s, r)
+			spans := exporter.GetSpans()
+			if recorded := len(spans) > 0; recorded != tt.recorded {
+				t.Fatalf("recorded %d spans, want recorded = %v", len(spans), tt.recorded)
+			}
+			if tt.recorded && spans[0].SpanContext.TraceID().String() == callerTrace {
+				t.Error("a malformed traceparent was trusted")
+			}
+		})
+	}
+}
+
+func TestTracingMarksServerErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	exporter := recordSpans(t, s, 1)
+	s.draining.Store(true) // /ready answers 503
+
+	serve(s, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	sp := spanNamed(t, exporter.GetSpans(), "GET /ready")
+	if sp.Status.Code != codes.Error || sp.Status.Description != "HTTP 503" {
+		t.Errorf("status = %+v, want an error", sp.Status)
+	}
+}
+
+func TestCallbackJoinsTrace(t *testing.T) {
+	var traceparent string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"success":true,"data":{"user_id":"7","url":"http://panel.example","username":"u","password":"p","is_active":true}}`))
+	}))
+	defer api.Close()
+	source := &callbackSource{url: api.URL + "/playlists/{id}", client: api.Client()}
+
+	provider := tracerProvider(TracingConfig{SampleRatio: 1}, sdktrace.WithSyncer(tracetest.NewInMemoryExporter()))
+	ctx, sp := provider.Tracer(tracerName).Start(context.Background(), "GET /get")
+	defer sp.End()
+	if _, err := source.Lookup(ctx, testPlaylistID); err != nil {
+		t.Fatal(err)
+	}
+	want := "00-" + sp.SpanContext().TraceID().String() + "-" + sp.SpanContext().SpanID().String() + "-01"
+	if traceparent != want {
+		t.Errorf("traceparent = %q, want %q", traceparent, want)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	if tp, err := newTracerProvider(TracingConfig{Exporter: tracingNone}); tp != nil || err != nil {
+		t.Errorf("tracing off = %v, %v; want no provider", tp, err)
+	}
+
+	posts := make(chan *http.Request, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts <- r
+	}))
+	defer collector.Close()
+
+	tp, err := newTracerProvider(TracingConfig{Exporter: tracingOTLP, Endpoint: collector.URL + "/v1/traces", ServiceName: "test", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sp := tp.Tracer(tracerName).Start(context.Background(), "GET /get")
+	sp.End()
+	if err := tp.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-posts:
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("collector got %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+	default:
+		t.Fatal("shutdown did not export the span")
+	}
+}